@@ -87,8 +87,8 @@ func SetToken(name string, token string, expTime int64) int {
 
 //check whether the tokens matched
 func CheckToken(name string, token string) int {
-	//stress test token whether match
-	if token == utils.TestToken {
+	//stress test token whether match, only accepted when TestTokenEnable is set
+	if utils.TestTokenEnable && token == utils.TestToken {
 		return utils.Success
 	}
 	//release token whether match
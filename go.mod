@@ -3,8 +3,8 @@ module GoUserManaSys
 go 1.18
 
 require (
-	github.com/go-redis/redis v6.15.9+incompatible // indirect
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
-	github.com/google/uuid v1.3.0 // indirect
-	gopkg.in/ini.v1 v1.66.6 // indirect
+	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/go-sql-driver/mysql v1.6.0
+	github.com/google/uuid v1.3.0
+	gopkg.in/ini.v1 v1.66.6
 )
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,7 +20,7 @@ import (
 
 var (
 	//rpc _client
-	_client rpc.Client
+	_client *rpc.Client
 	//template parameters
 	_loginT   *template.Template
 	_profileT *template.Template
@@ -42,10 +43,20 @@ func main() {
 	}
 	var err error
 	//creat rpc _client connect pool
-	_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
+	_client, err = newClient()
 	if err != nil {
 		fmt.Println(err)
-		_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
+		_client, err = newClient()
+	}
+	if err != nil {
+		//every handler needs the client, don't serve without it
+		log.ErrorLog("http_server: create rpc client failed. err:%s", err)
+		fmt.Println(err)
+		return
+	}
+	//tcpserver tells when a session is revoked or a profile changes
+	if _, err = _client.Subscribe(utils.TopicUser, onUserEvent); err != nil {
+		fmt.Println(err)
 	}
 	//
 	http.Handle("/static/",
@@ -83,6 +94,9 @@ func gracefulExit() {
 //handle add user requst
 func AddUser(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		userName := req.FormValue("username")
 		fmt.Println(userName)
 		//use template.HTMLEscapeString to handle special symbols '"<>_ to avoid sql injection
@@ -102,21 +116,11 @@ func AddUser(res http.ResponseWriter, req *http.Request) {
 			NickName: nickName,
 		}
 		rsp := utils.ResAdd{}
-		err := _client.Call("AddUser", req, &rsp)
-		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("AddUser", req, &rsp); err != nil {
-				log.ErrorLog("http_server_add: call failed.username:%s,err:%s", userName, err)
-			}
+		if err := _client.CallContext(ctx, "AddUser", req, &rsp); err != nil {
+			log.ErrorLog("http_server_add: call failed.username:%s,err:%s", userName, err)
+			writeCallStatus(res, err)
+			templateAdd(res, utils.MsgAdd{Msg: callErrMsg(err)})
+			return
 		}
 		//display front-end page and jump
 		switch rsp.Code {
@@ -135,6 +139,9 @@ func AddUser(res http.ResponseWriter, req *http.Request) {
 //handle the login request
 func Login(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		userName := req.FormValue("username")
 		userName = template.HTMLEscapeString(userName)
 		passWord := req.FormValue("password")
@@ -150,21 +157,11 @@ func Login(res http.ResponseWriter, req *http.Request) {
 		}
 		//response
 		rsp := utils.ResLogin{}
-		err := _client.Call("Login", req, &rsp)
-		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("Login", req, &rsp); err != nil {
-				log.ErrorLog("http_server_login: call failed.username:%s,err:%s", userName, err)
-			}
+		if err := _client.CallContext(ctx, "Login", req, &rsp); err != nil {
+			log.ErrorLog("http_server_login: call failed.username:%s,err:%s", userName, err)
+			writeCallStatus(res, err)
+			templateLogin(res, utils.MsgLogin{Msg: callErrMsg(err)})
+			return
 		}
 		if rsp.Code == utils.Success {
 			//if login success,then send token as cookie to http
@@ -187,6 +184,9 @@ func Login(res http.ResponseWriter, req *http.Request) {
 func Logout(res http.ResponseWriter, req *http.Request) {
 	//get token from cookie
 	if req.Method == "POST" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		token, err := req.Cookie("token")
 		if err != nil {
 			templateLogin(res, utils.MsgLogin{Msg: ""})
@@ -198,21 +198,8 @@ func Logout(res http.ResponseWriter, req *http.Request) {
 			Token:    token.Value,
 		}
 		rsp := utils.ResLogout{}
-		err = _client.Call("Logout", req, &rsp)
-		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("Logout", req, &rsp); err != nil {
-				log.ErrorLog("http_server_logout: call failed.username:%s,err:%s", userName, err)
-			}
+		if err = _client.CallContext(ctx, "Logout", req, &rsp); err != nil {
+			log.ErrorLog("http_server_logout: call failed.username:%s,err:%s", userName, err)
 		}
 		templateLogin(res, utils.MsgLogin{Msg: "请登录！"})
 		log.InfoLog("http_server_logout: logout.username:%s,err:%s", userName, err)
@@ -222,6 +209,9 @@ func Logout(res http.ResponseWriter, req *http.Request) {
 //handle getinfo request
 func GetInfo(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "GET" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		//get token from cookie
 		token, err := req.Cookie("token")
 		if err != nil {
@@ -237,21 +227,21 @@ func GetInfo(res http.ResponseWriter, req *http.Request) {
 		}
 		rsp := utils.ResGetInfo{}
 		//call rpc server to get user information
-		err = _client.Call("GetInfo", req, &rsp)
-		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("GetInfo", req, &rsp); err != nil {
-				log.ErrorLog("http_server_GetInfo: call failed.username:%s,err:%s", userName, err)
+		if err = _client.CallContext(ctx, "GetInfo", req, &rsp); err != nil {
+			log.ErrorLog("http_server_GetInfo: call failed.username:%s,err:%s", userName, err)
+			writeCallStatus(res, err)
+			//tcpserver is in trouble, show the page without the stored info instead of an error
+			if errors.Is(err, rpc.ErrCircuitOpen) {
+				templateProfile(res, utils.MsgGetInfo{
+					UserName:       userName,
+					NickName:       callErrMsg(err),
+					ProfilePicture: utils.DefaultImage})
+				return
 			}
+			templateJump(res, utils.MsgJump{
+				UserName: userName,
+				Msg:      callErrMsg(err)})
+			return
 		}
 		//getting success
 		if rsp.Code == utils.Success {
@@ -291,6 +281,9 @@ func GetInfo(res http.ResponseWriter, req *http.Request) {
 //handle update nickname request
 func UpdateNickName(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		//get token from cookie
 		token, err := req.Cookie("token")
 		if err != nil {
@@ -308,21 +301,13 @@ func UpdateNickName(res http.ResponseWriter, req *http.Request) {
 			Token:    token.Value,
 		}
 		rsp := utils.ResUpdNickName{}
-		err = _client.Call("UpdateNickName", req, &rsp)
-		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("UpdateNickName", req, &rsp); err != nil {
-				log.ErrorLog("http_server_UpdateNickName: call failed.username:%s,err:%s", userName, err)
-			}
+		if err = _client.CallContext(ctx, "UpdateNickName", req, &rsp); err != nil {
+			log.ErrorLog("http_server_UpdateNickName: call failed.username:%s,err:%s", userName, err)
+			writeCallStatus(res, err)
+			templateJump(res, utils.MsgJump{
+				UserName: userName,
+				Msg:      callErrMsg(err)})
+			return
 		}
 		switch rsp.Code {
 		case utils.ErrUserNotExit:
@@ -351,6 +336,9 @@ func UpdateNickName(res http.ResponseWriter, req *http.Request) {
 //handle upload profile picture request
 func UploadPic(res http.ResponseWriter, req *http.Request) {
 	if req.Method == "POST" {
+		//rpc calls stop when the browser leaves or utils.CallTimeout passes
+		ctx, cancel := callContext(req)
+		defer cancel()
 		// get token from cookie
 		token, err := req.Cookie("token")
 		if err != nil {
@@ -373,40 +361,20 @@ func UploadPic(res http.ResponseWriter, req *http.Request) {
 			templateJump(res, utils.MsgJump{Msg: "请上传正确格式文件"})
 			return
 		}
-		//rename the image to avoid name repeat
-		newName := utils.NewImgName(head.Filename)
-		filepath := utils.StaticFilePath + newName
-		showFile, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
-		defer showFile.Close()
-		//add the image to the filepath
-		_, err = io.Copy(showFile, file)
-		if err != nil {
-			templateJump(res, utils.MsgJump{
-				UserName: userName,
-				Msg:      "写入图片错误"})
-		}
-		//
-		req := utils.ReqUploadPic{
+		//the tcpserver checks and saves the picture
+		req := utils.ReqUploadPicStream{
 			UserName: userName,
-			Picture:  newName,
+			FileName: head.Filename,
 			Token:    token.Value,
 		}
-		rsp := utils.ResUploadPic{}
-		err = _client.Call("UploadPic", req, &rsp)
+		rsp, err := uploadPic(ctx, req, file)
 		if err != nil {
-
-			fmt.Println("Disconnected, re-establishing connection...")
-			//close pool
-			_client.Close()
-			//re-creat rpc client
-			_client, err = rpc.NewClient(utils.ClientPoolSize, utils.ServerPort)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println("Successfully re-established connection...")
-			if err = _client.Call("Login", req, &rsp); err != nil {
-				log.ErrorLog("http_server_UploadPic: call failed.username:%s,err:%s", userName, err)
-			}
+			log.ErrorLog("http_server_UploadPic: call failed.username:%s,err:%s", userName, err)
+			writeCallStatus(res, err)
+			templateJump(res, utils.MsgJump{
+				UserName: userName,
+				Msg:      callErrMsg(err)})
+			return
 		}
 		switch rsp.Code {
 		case utils.Success:
@@ -424,6 +392,14 @@ func UploadPic(res http.ResponseWriter, req *http.Request) {
 			templateJump(res, utils.MsgJump{
 				UserName: userName,
 				Msg:      "用户不存在"})
+		case utils.ErrPicFormat:
+			templateJump(res, utils.MsgJump{
+				UserName: userName,
+				Msg:      "请上传正确格式文件"})
+		case utils.ErrPicSize:
+			templateJump(res, utils.MsgJump{
+				UserName: userName,
+				Msg:      "图片过大"})
 		default:
 			templateJump(res, utils.MsgJump{
 				UserName: userName,
@@ -434,6 +410,171 @@ func UploadPic(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
+//stream the picture to the tcpserver in chunks of utils.PicChunkSize,
+//it checks the picture and saves it
+func uploadPic(ctx context.Context, req utils.ReqUploadPicStream, pic io.Reader) (rsp utils.ResUploadPic, err error) {
+	st, err := _client.NewStream(ctx, "UploadPicStream", req)
+	if err != nil {
+		return rsp, err
+	}
+	buf := make([]byte, utils.PicChunkSize)
+	for {
+		n, rerr := pic.Read(buf)
+		if n > 0 {
+			err = st.Send(utils.PicChunk{Data: buf[:n]})
+			if err == io.EOF {
+				//the tcpserver refused the picture, the result says why
+				break
+			}
+			if err != nil {
+				return rsp, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			//canceling ctx stops the stream
+			return rsp, rerr
+		}
+	}
+	err = st.CloseAndRecv(&rsp)
+	return rsp, err
+}
+
+//creat rpc _client connect pool, connections are dialed on demand and broken ones are replaced by the client
+func newClient() (*rpc.Client, error) {
+	tr, err := rpc.NetworkTransport(utils.RpcNetwork)
+	if err != nil {
+		return nil, err
+	}
+	opts := []rpc.Option{
+		rpc.WithTransport(tr),
+		rpc.WithMaxFrameSize(utils.MaxFrameSize), rpc.WithCodecs(utils.RpcCodec),
+		rpc.WithBalancer(newBalancer()), rpc.WithResolveInterval(utils.RpcResolveInterval),
+		rpc.WithHeartbeat(utils.HeartbeatInterval, utils.HeartbeatTimeout),
+		rpc.WithPool(rpc.PoolConfig{
+			MinConns:    utils.PoolMinConns,
+			MaxStreams:  utils.PoolMaxStreams,
+			IdleTimeout: utils.PoolIdleTimeout,
+			WaitTimeout: utils.PoolWaitTimeout,
+		}),
+		rpc.WithBreaker(rpc.BreakerPolicy{
+			Window:      utils.BreakerWindow,
+			MinRequests: utils.BreakerMinRequests,
+			ErrorRate:   utils.BreakerErrorRate,
+			SlowCall:    utils.BreakerSlowCall,
+			SlowRate:    utils.BreakerSlowRate,
+			OpenFor:     utils.BreakerOpenFor,
+		}),
+		rpc.WithRetry(rpc.RetryPolicy{
+			MaxAttempts: utils.RetryTimes,
+			Backoff:     utils.RetryBackoff,
+			MaxBackoff:  time.Second,
+			//AddUser is left out, running it twice answers "user exists",
+			//and Login, every run issues another token
+			Idempotent: []string{"GetInfo", "UpdateNickName", "Logout"},
+		}),
+	}
+	if len(utils.RpcCompression) > 0 {
+		opts = append(opts, rpc.WithCompression(utils.RpcCompressSize, utils.RpcCompression...))
+	}
+	if utils.TLSEnable {
+		cfg, err := rpc.ClientTLSConfig(utils.TLSCAFile, utils.TLSClientCertFile, utils.TLSClientKeyFile, utils.TLSServerName)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, rpc.WithTLS(cfg))
+	}
+	if utils.AuthKeys != "" {
+		k, err := rpc.ParseKeyring(utils.AuthKeys, utils.AuthKeyID)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, rpc.WithAuth(k))
+	}
+	return rpc.NewResolverClient(utils.ClientPoolSize, newResolver(), opts...)
+}
+
+//where the tcpservers are found, named by utils.RpcDiscovery
+func newResolver() rpc.Resolver {
+	switch utils.RpcDiscovery {
+	case "srv":
+		return rpc.SRVResolver(utils.RpcSRV)
+	case "file":
+		return rpc.FileResolver(utils.RpcEndpointsFile)
+	}
+	return rpc.StaticResolver(utils.RpcEndpoints...)
+}
+
+//balancer of the rpc calls named by utils.RpcBalancer
+func newBalancer() rpc.Balancer {
+	switch utils.RpcBalancer {
+	case "least_outstanding":
+		return rpc.LeastOutstanding()
+	case "consistent_hash":
+		return rpc.ConsistentHash(userKey)
+	}
+	return rpc.RoundRobin()
+}
+
+//calls of the same user go to the same tcpserver while it is healthy
+func userKey(method string, req interface{}) string {
+	if r, ok := req.(utils.UserReq); ok {
+		return r.GetUserName()
+	}
+	return ""
+}
+
+//context of an rpc call made for the http request
+func callContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), utils.CallTimeout)
+}
+
+//message shown to the user when the rpc call fails
+func callErrMsg(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "请求超时，请稍后重试"
+	case errors.Is(err, rpc.ErrPoolTimeout):
+		return "服务繁忙，请稍后重试"
+	case errors.Is(err, rpc.ErrCircuitOpen):
+		return "服务繁忙，部分功能暂时不可用"
+	case errors.Is(err, rpc.ErrOverloaded):
+		return "访问人数过多，请稍后重试"
+	case errors.Is(err, rpc.ErrMethodNotFound), errors.Is(err, rpc.ErrBadRequest):
+		return "请求错误"
+	case errors.Is(err, rpc.ErrInternal):
+		return "服务器内部错误"
+	}
+	return "服务暂时不可用，请稍后重试"
+}
+
+//answer calls the tcpserver refused for its limits with 429 or 503, so
+//clients and proxies back off. other failures keep the page with status 200.
+func writeCallStatus(res http.ResponseWriter, err error) {
+	var e *rpc.Error
+	if !errors.As(err, &e) || e.Code != rpc.CodeOverloaded {
+		return
+	}
+	if e.Details["limit"] == rpc.LimitRate {
+		res.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	res.WriteHeader(http.StatusServiceUnavailable)
+}
+
+//a user changed in tcpserver. httpserver keeps no state of the users yet,
+//so the event is only logged
+func onUserEvent(m *rpc.Message) {
+	var e utils.UserEvent
+	if err := m.Decode(&e); err != nil {
+		log.ErrorLog("http_server_event: bad user event. err:%s", err)
+		return
+	}
+	log.InfoLog("http_server_event: username:%s changed: %s", e.UserName, e.Event)
+}
+
 //http login page.
 func templateLogin(rw http.ResponseWriter, resp utils.MsgLogin) {
 	if err := _loginT.Execute(rw, resp); err != nil {
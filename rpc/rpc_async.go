@@ -0,0 +1,42 @@
+package rpc
+
+import "context"
+
+//a call started by Go. Done receives the call once it finished, then
+//Error holds what CallContext would have returned and Res is filled.
+type Call struct {
+	Name  string
+	Req   interface{}
+	Res   interface{}
+	Error error
+	Done  chan *Call //buffered, the result never waits for the receiver
+}
+
+//start the call in the background and return at once
+func (c *Client) Go(name string, req interface{}, res interface{}) *Call {
+	return c.GoContext(context.Background(), name, req, res)
+}
+
+//start the call in the background, it gives up when ctx is done.
+//it goes through the interceptors and retries like CallContext.
+func (c *Client) GoContext(ctx context.Context, name string, req interface{}, res interface{}) *Call {
+	call := &Call{Name: name, Req: req, Res: res, Done: make(chan *Call, 1)}
+	go func() {
+		call.Error = c.CallContext(ctx, name, req, res)
+		call.Done <- call
+	}()
+	return call
+}
+
+//wait for all the calls and return the first error in their order. it
+//takes the calls from their Done channels, don't receive them again.
+func Wait(calls ...*Call) error {
+	var firstErr error
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil && firstErr == nil {
+			firstErr = call.Error
+		}
+	}
+	return firstErr
+}
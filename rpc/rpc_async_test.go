@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGo(t *testing.T) {
+	s := NewServer()
+	//every call waits until all of them arrived, so they must run at once
+	const n = 5
+	var mu sync.Mutex
+	arrived := 0
+	all := make(chan struct{})
+	RegisterFunc(s, "Gather", func(ctx context.Context, r addReq) (addRes, error) {
+		mu.Lock()
+		if arrived++; arrived == n {
+			close(all)
+		}
+		mu.Unlock()
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+			return addRes{}, Errorf(CodeInternal, "calls ran one after the other")
+		}
+		if r.A < 0 {
+			return addRes{}, Errorf(CodeBadRequest, "negative")
+		}
+		return addRes{r.A + r.B}, nil
+	})
+	c := newTestClient(t, serve(t, s))
+	var res [n]addRes
+	var calls []*Call
+	for i := range res {
+		calls = append(calls, c.Go("Gather", addReq{i, 1}, &res[i]))
+	}
+	if err := Wait(calls...); err != nil {
+		t.Fatal(err)
+	}
+	for i := range res {
+		if res[i].Sum != i+1 || calls[i].Res != &res[i] || calls[i].Name != "Gather" {
+			t.Fatal(i, res[i], calls[i])
+		}
+	}
+	//Done gets the call with its error
+	bad := c.Go("Gather", addReq{-1, 0}, &addRes{})
+	if call := <-bad.Done; call != bad || !errors.Is(call.Error, ErrBadRequest) {
+		t.Fatal(call.Error)
+	}
+}
+
+func TestGoContext(t *testing.T) {
+	c := newTestClient(t, serve(t, slowServer()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	slow := c.GoContext(ctx, "Slow", addReq{A: 5000}, &addRes{})
+	fast := c.Go("Slow", addReq{A: 1}, &addRes{})
+	//the first error in the order of the calls
+	if err := Wait(fast, slow); err != context.DeadlineExceeded || fast.Error != nil {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,186 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//size of the random challenge the server sends
+const nonceSize = 32
+
+//prefix of the signed challenge, so the mac can't be reused elsewhere
+const authContext = "GoUserManaSys rpc auth v1\n"
+
+var ErrNoKey = errors.New("rpc_auth: no key to sign with")
+
+//shared keys of trusted peers by id. a server accepts a client which signs
+//its challenge with any of the keys, a client signs with the current one.
+//to rotate: add the new key on the servers, make it current on the
+//clients, then remove the old key from the servers. safe for concurrent use.
+type Keyring struct {
+	mu      sync.RWMutex //protect the fields below
+	keys    map[string][]byte
+	current string
+}
+
+//keyring with one key which is the current one
+func NewKeyring(id string, key []byte) *Keyring {
+	k := &Keyring{keys: make(map[string][]byte)}
+	k.Add(id, key)
+	k.current = id
+	return k
+}
+
+//parse "id:secret,id2:secret2". current is the id clients sign with, the
+//first key when empty
+func ParseKeyring(keys, current string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte)}
+	for _, kv := range strings.Split(keys, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.IndexByte(kv, ':')
+		if i <= 0 || i == len(kv)-1 {
+			return nil, fmt.Errorf("rpc_auth: bad key %q, want id:secret", kv)
+		}
+		k.Add(kv[:i], []byte(kv[i+1:]))
+		if current == "" {
+			current = kv[:i]
+		}
+	}
+	if err := k.Use(current); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+//add or replace a key
+func (k *Keyring) Add(id string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+}
+
+//stop accepting a key, it can't be removed while it is the current one
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.current {
+		return fmt.Errorf("rpc_auth: key %q is in use", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+//sign with the key id from now on
+func (k *Keyring) Use(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("rpc_auth: no key %q", id)
+	}
+	k.current = id
+	return nil
+}
+
+//sign the challenge with the current key
+func (k *Keyring) sign(nonce []byte) (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.current]
+	if !ok {
+		return "", nil, ErrNoKey
+	}
+	return k.current, authMAC(key, nonce), nil
+}
+
+//whether mac is the challenge signed with key id
+func (k *Keyring) verify(id string, nonce, mac []byte) bool {
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+	return ok && hmac.Equal(mac, authMAC(key, nonce))
+}
+
+func authMAC(key, nonce []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(authContext))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+//only peers holding a key of the keyring may talk. a server challenges
+//every client in the handshake, a client answers with the current key.
+func WithAuth(k *Keyring) Option {
+	return func(o *options) {
+		o.auth = k
+	}
+}
+
+//body of the auth frame, the answer of the client to the challenge
+type authProof struct {
+	KeyID string `json:"keyId"`
+	MAC   []byte `json:"mac"`
+}
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+//read the answer of the client to the challenge and tell it the result
+func (sc *serverConn) authenticate(nonce []byte) error {
+	sc.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer sc.conn.SetReadDeadline(time.Time{})
+	f, err := readFrame(sc.r, sc.s.opts.maxFrameSize)
+	if err != nil {
+		return err
+	}
+	var p authProof
+	if f.kind != kindAuth || json.Unmarshal(f.body, &p) != nil || !sc.s.opts.auth.verify(p.KeyID, nonce, p.MAC) {
+		e := Errorf(CodeUnauthenticated, "bad key or signature")
+		sc.write(&frame{kind: kindAuth, flags: flagError, body: encodeError(e)})
+		return fmt.Errorf("rpc_server: client %s %v", sc.conn.RemoteAddr(), e)
+	}
+	return sc.write(&frame{kind: kindAuth})
+}
+
+//answer the challenge of the server and read the result
+func (cc *clientConn) authenticate(nonce []byte) error {
+	if cc.auth == nil {
+		return Errorf(CodeUnauthenticated, "server requires a key")
+	}
+	id, mac, err := cc.auth.sign(nonce)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(authProof{KeyID: id, MAC: mac})
+	if err != nil {
+		return err
+	}
+	if err = writeFrame(cc.conn, &frame{kind: kindAuth, body: body}); err != nil {
+		return err
+	}
+	f, err := readFrame(cc.r, cc.maxFrame)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	if f.kind != kindAuth {
+		return fmt.Errorf("%w: unexpected frame kind %d", ErrBadHandshake, f.kind)
+	}
+	if f.flags&flagError != 0 {
+		return decodeError(f.body)
+	}
+	return nil
+}
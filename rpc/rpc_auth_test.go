@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"errors"
+	"testing"
+)
+
+func authCall(t *testing.T, addr string, opts ...Option) error {
+	t.Helper()
+	return newTestClient(t, addr, opts...).Call("Add", addReq{1, 2}, &addRes{})
+}
+
+func TestAuth(t *testing.T) {
+	keys, err := ParseKeyring("k1:secret1,k2:secret2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithAuth(keys))
+	RegisterFunc(s, "Add", add)
+	addr := serve(t, s)
+	for _, k := range []*Keyring{NewKeyring("k1", []byte("secret1")), NewKeyring("k2", []byte("secret2"))} {
+		if err := authCall(t, addr, WithAuth(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := authCall(t, addr, WithAuth(NewKeyring("k1", []byte("wrong")))); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("wrong key: got %v, want unauthenticated", err)
+	}
+	if err := authCall(t, addr, WithAuth(NewKeyring("k3", []byte("secret1")))); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("unknown key id: got %v, want unauthenticated", err)
+	}
+	if err := authCall(t, addr); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("no key: got %v, want unauthenticated", err)
+	}
+}
+
+func TestAuthRotation(t *testing.T) {
+	keys := NewKeyring("k1", []byte("secret1"))
+	s := NewServer(WithAuth(keys))
+	RegisterFunc(s, "Add", add)
+	addr := serve(t, s)
+	client := NewKeyring("k1", []byte("secret1"))
+	c := newTestClient(t, addr, WithAuth(client))
+	if err := c.Call("Add", addReq{1, 2}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	//the server learns the new key first, then the client switches to it
+	keys.Add("k2", []byte("secret2"))
+	client.Add("k2", []byte("secret2"))
+	if err := client.Use("k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authCall(t, addr, WithAuth(client)); err != nil {
+		t.Fatal(err)
+	}
+	//the old key is dropped, connections made with it keep working
+	if err := keys.Use("k2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Remove("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authCall(t, addr, WithAuth(NewKeyring("k1", []byte("secret1")))); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("removed key: got %v, want unauthenticated", err)
+	}
+	if err := c.Call("Add", addReq{1, 2}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Remove("k2"); err == nil {
+		t.Fatal("removed the key in use")
+	}
+}
+
+func TestAuthNotRequired(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", add)
+	//a client with a key talks to a server without one
+	if err := authCall(t, serve(t, s), WithAuth(NewKeyring("k1", []byte("secret1")))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,255 @@
+package rpc
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+//what a balancer knows about a server of the client
+type Endpoint interface {
+	Addr() string     //address of the server
+	Outstanding() int //calls in flight on the server
+}
+
+//choose the server of each call. endpoints holds the healthy servers and is
+//never empty, Pick returns the index of the chosen one.
+type Balancer interface {
+	Pick(method string, req interface{}, endpoints []Endpoint) int
+}
+
+//when a server is skipped by the balancer after connection failures
+type EjectPolicy struct {
+	Failures int           //connection failures in a row which eject the server, 3 when 0
+	Duration time.Duration //how long it stays ejected, 10s when 0. one more failure after that ejects it again
+}
+
+//numbers of one server of the client
+type EndpointStats struct {
+	Addr        string
+	Ejected     bool //skipped by the balancer now
+	Outstanding int  //calls in flight
+	Pool        PoolStats
+	Breakers    map[string]BreakerState //circuit breakers by method
+}
+
+//set how the client chooses the server of a call, round-robin by default
+func WithBalancer(b Balancer) Option {
+	return func(o *options) {
+		o.balancer = b
+	}
+}
+
+//set when unhealthy servers are ejected
+func WithEjection(p EjectPolicy) Option {
+	return func(o *options) {
+		o.eject = p
+	}
+}
+
+//fill the zero fields of the policy
+func (p EjectPolicy) normalize() EjectPolicy {
+	if p.Failures <= 0 {
+		p.Failures = 3
+	}
+	if p.Duration <= 0 {
+		p.Duration = 10 * time.Second
+	}
+	return p
+}
+
+type roundRobin struct {
+	next uint32
+}
+
+//servers in turn
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (b *roundRobin) Pick(method string, req interface{}, endpoints []Endpoint) int {
+	return int(atomic.AddUint32(&b.next, 1) % uint32(len(endpoints)))
+}
+
+type leastOutstanding struct {
+	next uint32
+}
+
+//the server with the fewest calls in flight, ties are broken in turn
+func LeastOutstanding() Balancer {
+	return &leastOutstanding{}
+}
+
+func (b *leastOutstanding) Pick(method string, req interface{}, endpoints []Endpoint) int {
+	start := int(atomic.AddUint32(&b.next, 1) % uint32(len(endpoints)))
+	best, min := start, -1
+	for i := range endpoints {
+		j := (start + i) % len(endpoints)
+		if n := endpoints[j].Outstanding(); min < 0 || n < min {
+			best, min = j, n
+		}
+	}
+	return best
+}
+
+//virtual nodes of each server on the hash ring
+const hashReplicas = 160
+
+//balancer which keeps state about all the servers of the client, the
+//client tells it every time they change
+type endpointsWatcher interface {
+	setEndpoints(endpoints []Endpoint)
+}
+
+//virtual node of a server on the hash ring
+type ringNode struct {
+	hash uint64
+	ep   Endpoint
+}
+
+type consistentHash struct {
+	key      func(method string, req interface{}) string
+	fallback roundRobin
+
+	mu   sync.RWMutex //protect the ring
+	ring []ringNode   //virtual nodes of all the servers sorted by hash
+}
+
+//the server owning the key of the request on a hash ring, so calls with
+//the same key go to the same server while it is healthy. the keys of a
+//skipped server go to the next servers on the ring, the others stay.
+//requests with an empty key go round-robin.
+func ConsistentHash(key func(method string, req interface{}) string) Balancer {
+	return &consistentHash{key: key}
+}
+
+//build the ring of the servers, called only when they change
+func (b *consistentHash) setEndpoints(endpoints []Endpoint) {
+	ring := make([]ringNode, 0, len(endpoints)*hashReplicas)
+	for _, ep := range endpoints {
+		for i := 0; i < hashReplicas; i++ {
+			ring = append(ring, ringNode{hash: hashString(ep.Addr() + "#" + strconv.Itoa(i)), ep: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	b.mu.Lock()
+	b.ring = ring
+	b.mu.Unlock()
+}
+
+func (b *consistentHash) Pick(method string, req interface{}, endpoints []Endpoint) int {
+	k := b.key(method, req)
+	if k == "" {
+		return b.fallback.Pick(method, req, endpoints)
+	}
+	h := hashString(k)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ring := b.ring
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	//the owner is almost always healthy, otherwise the next server on the ring
+	for n := 0; n < len(ring); n++ {
+		owner := ring[(start+n)%len(ring)].ep
+		for i, ep := range endpoints {
+			if ep == owner {
+				return i
+			}
+		}
+	}
+	//a ring without these servers, the client didn't tell the balancer
+	return b.fallback.Pick(method, req, endpoints)
+}
+
+//64-bit FNV-1a with the murmur3 finalizer. FNV alone leaves short, similar
+//strings like "host:port#1" and "host:port#2" close together on the ring.
+func hashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+//choose the server of the call among the ones not ejected, all of them
+//when every one is ejected. servers whose breaker of the method is open
+//are skipped, ErrCircuitOpen when that leaves none.
+func (c *Client) pick(method string, req interface{}) (*endpoint, error) {
+	all := c.getEndpoints()
+	now := time.Now()
+	healthy := make([]Endpoint, 0, len(all))
+	ready := make([]Endpoint, 0, len(all))
+	for _, ep := range all {
+		if !ep.breaker(method).ready() {
+			continue
+		}
+		ready = append(ready, ep)
+		if !ep.ejected(now) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = ready
+	}
+	if len(healthy) == 0 {
+		return nil, ErrCircuitOpen
+	}
+	return healthy[c.opts.balancer.Pick(method, req, healthy)].(*endpoint), nil
+}
+
+//whether the balancer skips the endpoint now
+func (ep *endpoint) ejected(now time.Time) bool {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return now.Before(ep.ejectedTill)
+}
+
+//record the outcome of a call on the endpoint. connection failures count,
+//an answer of the server makes it healthy again, other errors tell nothing
+func (ep *endpoint) report(err error) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	switch err.(type) {
+	case *ConnError:
+		ep.fail()
+	case nil, *Error:
+		ep.failures = 0
+		ep.ejectedTill = time.Time{}
+	}
+}
+
+//count a connection failure and eject the endpoint after too many, called with ep.mu held
+func (ep *endpoint) fail() {
+	p := &ep.opts.eject
+	ep.failures++
+	if ep.failures >= p.Failures && !time.Now().Before(ep.ejectedTill) {
+		ep.ejectedTill = time.Now().Add(p.Duration)
+		log.ErrorLog("rpc_client: eject %s for %s after %d connection failures", ep.addr, p.Duration, ep.failures)
+	}
+}
+
+//numbers of every server of the client
+func (c *Client) EndpointStats() []EndpointStats {
+	now := time.Now()
+	eps := c.getEndpoints()
+	sts := make([]EndpointStats, 0, len(eps))
+	for _, ep := range eps {
+		sts = append(sts, EndpointStats{
+			Addr:        ep.Addr(),
+			Ejected:     ep.ejected(now),
+			Outstanding: ep.Outstanding(),
+			Pool:        ep.stats(),
+			Breakers:    ep.breakerStates(),
+		})
+	}
+	return sts
+}
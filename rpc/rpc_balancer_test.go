@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//servers which answer "Who" with their index
+func whoServers(t *testing.T, n int) ([]*Server, []string) {
+	var servers []*Server
+	var addrs []string
+	for i := 0; i < n; i++ {
+		i := i
+		s := NewServer()
+		RegisterFunc(s, "Who", func(ctx context.Context, r nameReq) (addRes, error) { return addRes{i}, nil })
+		servers = append(servers, s)
+		addrs = append(addrs, serve(t, s))
+	}
+	return servers, addrs
+}
+
+//servers like whoServers on a memory transport with fixed names, so the
+//hash ring is the same in every run. the option makes clients reach them.
+func memoryWhoServers(t *testing.T, n int) ([]*Server, []string, Option) {
+	m := NewMemory()
+	var servers []*Server
+	var addrs []string
+	for i := 0; i < n; i++ {
+		i := i
+		s := NewServer(WithTransport(m))
+		RegisterFunc(s, "Who", func(ctx context.Context, r nameReq) (addRes, error) { return addRes{i}, nil })
+		addr := "tcpserver" + strconv.Itoa(i)
+		l, err := s.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(l)
+		t.Cleanup(func() { s.Shutdown(context.Background()) })
+		servers = append(servers, s)
+		addrs = append(addrs, addr)
+	}
+	return servers, addrs, WithTransport(m)
+}
+
+func newTestMultiClient(t *testing.T, addrs []string, opts ...Option) *Client {
+	t.Helper()
+	c, err := NewMultiClient(2, addrs, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func who(t *testing.T, c *Client, name string) int {
+	t.Helper()
+	var res addRes
+	if err := c.Call("Who", nameReq{name}, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Sum
+}
+
+func TestRoundRobin(t *testing.T) {
+	_, addrs := whoServers(t, 3)
+	c := newTestMultiClient(t, addrs)
+	seen := map[int]int{}
+	for i := 0; i < 9; i++ {
+		seen[who(t, c, "")]++
+	}
+	for i := 0; i < 3; i++ {
+		if seen[i] != 3 {
+			t.Fatalf("calls per server %v, want 3 each", seen)
+		}
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	servers, addrs, transport := memoryWhoServers(t, 3)
+	key := func(method string, req interface{}) string { return req.(nameReq).Name }
+	c := newTestMultiClient(t, addrs, transport, WithBalancer(ConsistentHash(key)), WithEjection(EjectPolicy{Failures: 1, Duration: time.Minute}),
+		WithRetry(RetryPolicy{MaxAttempts: 3}))
+	owner := map[string]int{}
+	owned := map[int]int{}
+	for i := 0; i < 20; i++ {
+		name := "user" + strconv.Itoa(i)
+		owner[name] = who(t, c, name)
+		owned[owner[name]]++
+		for j := 0; j < 2; j++ {
+			if got := who(t, c, name); got != owner[name] {
+				t.Fatalf("%s went to %d, then to %d", name, owner[name], got)
+			}
+		}
+	}
+	//the names are fixed, so are the keys of every server
+	if len(owned) != 3 {
+		t.Fatalf("keys per server %v, want keys on all of them", owned)
+	}
+	//the users of server 1 move, the others stay
+	servers[1].Shutdown(context.Background())
+	time.Sleep(50 * time.Millisecond)
+	for name, o := range owner {
+		got := who(t, c, name)
+		if o != 1 && got != o {
+			t.Fatalf("%s moved from %d to %d", name, o, got)
+		}
+		if o == 1 && got == 1 {
+			t.Fatalf("%s still goes to the stopped server", name)
+		}
+	}
+}
+
+//server known by its address alone
+type fakeEndpoint string
+
+func (e fakeEndpoint) Addr() string     { return string(e) }
+func (e fakeEndpoint) Outstanding() int { return 0 }
+
+//every server owns about a third of the keys, whatever the addresses
+func TestConsistentHashSpread(t *testing.T) {
+	key := func(method string, req interface{}) string { return req.(nameReq).Name }
+	for _, addrs := range [][]string{
+		{"127.0.0.1:3000", "127.0.0.1:3001", "127.0.0.1:3002"},
+		{"127.0.0.1:41234", "127.0.0.1:41235", "127.0.0.1:41247"},
+		{"10.0.0.1:3000", "10.0.0.2:3000", "10.0.0.3:3000"},
+		{"/tmp/tcpserver1.sock", "/tmp/tcpserver2.sock", "/tmp/tcpserver3.sock"},
+	} {
+		b := ConsistentHash(key).(*consistentHash)
+		eps := make([]Endpoint, len(addrs))
+		for i, a := range addrs {
+			eps[i] = fakeEndpoint(a)
+		}
+		b.setEndpoints(eps)
+		const keys = 30000
+		count := make([]int, len(eps))
+		for i := 0; i < keys; i++ {
+			count[b.Pick("Who", nameReq{"user" + strconv.Itoa(i)}, eps)]++
+		}
+		for i, n := range count {
+			if n < keys/4 || n > keys*5/12 {
+				t.Fatalf("%s owns %d of %d keys, counts %v", addrs[i], n, keys, count)
+			}
+		}
+		//the ring is built when the servers change, not by Pick
+		req := interface{}(nameReq{"bob"})
+		if n := testing.AllocsPerRun(100, func() { b.Pick("Who", req, eps) }); n != 0 {
+			t.Fatalf("pick allocates %g times", n)
+		}
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	servers, addrs := whoServers(t, 2)
+	c := newTestMultiClient(t, addrs, WithBalancer(LeastOutstanding()), WithEjection(EjectPolicy{Failures: 1, Duration: time.Minute}),
+		WithRetry(RetryPolicy{MaxAttempts: 2}))
+	servers[0].Shutdown(context.Background())
+	for i := 0; i < 5; i++ {
+		if got := who(t, c, ""); got != 1 {
+			t.Fatalf("call went to server %d", got)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//batch items the server runs at once by default
+const defaultBatchWorkers = 8
+
+//one call of a batch. Err holds the failure of this call alone, Res is
+//filled when it is nil.
+type BatchCall struct {
+	Name string
+	Req  interface{}
+	Res  interface{}
+	Err  error
+}
+
+//set how many batch items the server runs at once, over all its batches
+func WithBatchWorkers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.batchWorkers = n
+		}
+	}
+}
+
+//body of a batch frame: count, then every request with its length
+func encodeBatch(reqs []Request) []byte {
+	e := binEncoder{}
+	e.uvarint(uint64(len(reqs)))
+	for _, r := range reqs {
+		b := encodeRequest(r)
+		e.uvarint(uint64(len(b)))
+		e.buf = append(e.buf, b...)
+	}
+	return e.buf
+}
+
+//parse the body of a batch frame
+func decodeBatch(body []byte) ([]Request, error) {
+	d := binDecoder{buf: body}
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]Request, n)
+	for i := range reqs {
+		l, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		b, _ := d.next(l)
+		if reqs[i], err = decodeRequest(b); err != nil {
+			return nil, err
+		}
+	}
+	return reqs, nil
+}
+
+//result of one item on the wire, body is an error when failed is set
+type batchResult struct {
+	failed bool
+	body   []byte
+}
+
+//body of the batch response: count, then every result with a flag and its length
+func encodeResults(results []batchResult) []byte {
+	e := binEncoder{}
+	e.uvarint(uint64(len(results)))
+	for _, r := range results {
+		if r.failed {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+		e.uvarint(uint64(len(r.body)))
+		e.buf = append(e.buf, r.body...)
+	}
+	return e.buf
+}
+
+//parse the body of the batch response
+func decodeResults(body []byte) ([]batchResult, error) {
+	d := binDecoder{buf: body}
+	n, err := d.length()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]batchResult, n)
+	for i := range results {
+		flag, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		l, err := d.length()
+		if err != nil {
+			return nil, err
+		}
+		b, _ := d.next(l)
+		results[i] = batchResult{failed: flag[0] != 0, body: b}
+	}
+	return results, nil
+}
+
+//a client sent a batch, run it in a goroutine
+func (sc *serverConn) batch(ctx context.Context, f *frame) {
+	reqs, err := decodeBatch(f.body)
+	if err != nil {
+		sc.writeError(f.id, Errorf(CodeBadRequest, "bad batch body: %v", err))
+		return
+	}
+	//counted as one request, so Shutdown waits for the whole batch
+	if !sc.s.begin() {
+		sc.writeError(f.id, errShuttingDown)
+		return
+	}
+	atomic.AddInt32(&sc.busy, 1)
+	go sc.serveBatch(ctx, f.id, reqs)
+}
+
+//run the items of a batch in the worker slots of the server and answer
+//with all the results in one response
+func (sc *serverConn) serveBatch(ctx context.Context, id uint64, reqs []Request) {
+	defer sc.s.end()
+	defer sc.done()
+	results := make([]batchResult, len(reqs))
+	var wg sync.WaitGroup
+	for i := range reqs {
+		//the slots are shared by every batch of the server
+		select {
+		case sc.s.batchSlots <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = batchResult{failed: true, body: encodeError(toError(ctx.Err()))}
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sc.s.batchSlots }()
+			results[i] = sc.serveItem(ctx, reqs[i])
+		}(i)
+	}
+	wg.Wait()
+	//nobody is waiting for the results any more
+	if ctx.Err() != nil {
+		return
+	}
+	body := encodeResults(results)
+	if uint32(len(body)) > sc.peerMaxFrame {
+		sc.writeError(id, Errorf(CodeInternal, "batch response of %d bytes is bigger than the client accepts", len(body)))
+		return
+	}
+	sc.write(&frame{kind: kindResponse, id: id, body: body})
+}
+
+//run one item of a batch like a single request
+func (sc *serverConn) serveItem(ctx context.Context, req Request) batchResult {
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout))
+		defer cancel()
+	}
+	resp, err := sc.s.find(ctx, sc.codec, req)
+	var data []byte
+	if err == nil {
+		data, err = sc.codec.Marshal(resp)
+		if err != nil {
+			err = Errorf(CodeInternal, "encode response: %v", err)
+		}
+	}
+	if err != nil {
+		return batchResult{failed: true, body: encodeError(toError(err))}
+	}
+	return batchResult{body: data}
+}
+
+//run the calls in one round trip to every server the balancer picks for
+//them, the servers run them concurrently. the error of a call is in its Err,
+//the returned error is the first one of a whole round trip, which is in the
+//Err of all its calls as well. calls skip the retries and the client
+//interceptors, the circuit breakers still count them.
+func (c *Client) CallBatch(ctx context.Context, calls []*BatchCall) error {
+	var firstErr error
+	//every call goes where a single call would go, keys of a hash balancer too
+	var eps []*endpoint
+	groups := make(map[*endpoint][]*BatchCall)
+	for _, call := range calls {
+		ep, err := c.pick(call.Name, call.Req)
+		if err != nil {
+			call.Err = err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if _, ok := groups[ep]; !ok {
+			eps = append(eps, ep)
+		}
+		groups[ep] = append(groups[ep], call)
+	}
+	errs := make([]error, len(eps))
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		wg.Add(1)
+		go func(i int, ep *endpoint) {
+			defer wg.Done()
+			errs[i] = ep.callBatch(ctx, groups[ep])
+		}(i, ep)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		for _, call := range groups[eps[i]] {
+			call.Err = err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+//send the calls allowed by their breakers in one batch frame, nothing is
+//sent when the breakers reject them all
+func (ep *endpoint) callBatch(ctx context.Context, calls []*BatchCall) error {
+	sent := make([]*BatchCall, 0, len(calls))
+	breakers := make([]*breaker, 0, len(calls))
+	for _, call := range calls {
+		b := ep.breaker(call.Name)
+		if !b.allow() {
+			call.Err = ErrCircuitOpen
+			continue
+		}
+		sent = append(sent, call)
+		breakers = append(breakers, b)
+	}
+	if len(sent) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := ep.sendBatch(ctx, sent)
+	took := time.Since(start)
+	ep.report(err)
+	for i, call := range sent {
+		e := call.Err
+		if err != nil {
+			e = err
+		}
+		breakers[i].done(call.Name, ep, e, took)
+	}
+	return err
+}
+
+//send the calls on one connection and hand out the results
+func (ep *endpoint) sendBatch(ctx context.Context, calls []*BatchCall) error {
+	cc, err := ep.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer ep.release(cc)
+	var timeout int64
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = int64(time.Until(deadline)); timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+	reqs := make([]Request, len(calls))
+	for i, call := range calls {
+		data, err := cc.codec.Marshal(call.Req)
+		if err != nil {
+			return err
+		}
+		reqs[i] = Request{ReqName: call.Name, ReqData: data, Timeout: timeout}
+	}
+	body := encodeBatch(reqs)
+	if uint32(len(body)) > cc.peerMaxFrame {
+		return ErrFrameTooBig
+	}
+	resp, err := cc.roundTrip(ctx, kindBatch, body)
+	if err != nil {
+		return err
+	}
+	if resp.flags&flagError != 0 {
+		return decodeError(resp.body)
+	}
+	results, err := decodeResults(resp.body)
+	if err == nil && len(results) != len(calls) {
+		err = errors.New("rpc_client: batch response doesn't match the calls")
+	}
+	if err != nil {
+		return err
+	}
+	for i, r := range results {
+		if r.failed {
+			calls[i].Err = decodeError(r.body)
+		} else {
+			calls[i].Err = cc.codec.Unmarshal(r.body, calls[i].Res)
+		}
+	}
+	return nil
+}
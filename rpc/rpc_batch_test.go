@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", func(ctx context.Context, r addReq) (addRes, error) {
+		if r.A < 0 {
+			return addRes{}, Errorf(CodeBadRequest, "negative")
+		}
+		return addRes{r.A + r.B}, nil
+	})
+	addr := serve(t, s)
+	for _, name := range codecNames {
+		c := newTestClient(t, addr, WithCodecs(name))
+		var calls []*BatchCall
+		for i := 0; i < 10; i++ {
+			calls = append(calls, &BatchCall{Name: "Add", Req: addReq{i, 1}, Res: &addRes{}})
+		}
+		calls[3].Req = addReq{-1, 0}
+		calls = append(calls, &BatchCall{Name: "Nope", Req: addReq{}, Res: &addRes{}})
+		if err := c.CallBatch(context.Background(), calls); err != nil {
+			t.Fatal(name, err)
+		}
+		for i, call := range calls[:10] {
+			if i == 3 {
+				if !errors.Is(call.Err, ErrBadRequest) {
+					t.Fatal(name, call.Err)
+				}
+				continue
+			}
+			if call.Err != nil || call.Res.(*addRes).Sum != i+1 {
+				t.Fatal(name, i, call.Err, call.Res)
+			}
+		}
+		if !errors.Is(calls[10].Err, ErrMethodNotFound) {
+			t.Fatal(name, calls[10].Err)
+		}
+	}
+}
+
+func TestBatchDeadline(t *testing.T) {
+	s := slowServer()
+	c := newTestClient(t, serve(t, s))
+	calls := []*BatchCall{{Name: "Slow", Req: addReq{A: 5000}, Res: &addRes{}}, {Name: "Slow", Req: addReq{A: 1}, Res: &addRes{}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := c.CallBatch(ctx, calls); err != context.DeadlineExceeded || calls[1].Err != err {
+		t.Fatalf("got %v and %v, want deadline exceeded", err, calls[1].Err)
+	}
+}
+
+//the worker limit holds for all the batches of the server together
+func TestBatchWorkersShared(t *testing.T) {
+	var running, most int32
+	s := NewServer(WithBatchWorkers(3))
+	RegisterFunc(s, "Add", func(ctx context.Context, r addReq) (addRes, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return addRes{r.A + r.B}, nil
+	})
+	addr := serve(t, s)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := newTestClient(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			calls := make([]*BatchCall, 5)
+			for j := range calls {
+				calls[j] = &BatchCall{Name: "Add", Req: addReq{j, 1}, Res: &addRes{}}
+			}
+			if err := c.CallBatch(context.Background(), calls); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 3 {
+		t.Fatalf("%d batch items ran at once, want 3", most)
+	}
+}
+
+//every call of a batch goes to the server a single call would go to
+func TestBatchConsistentHash(t *testing.T) {
+	_, addrs, transport := memoryWhoServers(t, 3)
+	key := func(method string, req interface{}) string { return req.(nameReq).Name }
+	c := newTestMultiClient(t, addrs, transport, WithBalancer(ConsistentHash(key)))
+	var calls []*BatchCall
+	for i := 0; i < 20; i++ {
+		calls = append(calls, &BatchCall{Name: "Who", Req: nameReq{"user" + strconv.Itoa(i)}, Res: &addRes{}})
+	}
+	if err := c.CallBatch(context.Background(), calls); err != nil {
+		t.Fatal(err)
+	}
+	servers := map[int]bool{}
+	for _, call := range calls {
+		name := call.Req.(nameReq).Name
+		got := call.Res.(*addRes).Sum
+		if call.Err != nil || got != who(t, c, name) {
+			t.Fatalf("%s went to %d in the batch, %v", name, got, call.Err)
+		}
+		servers[got] = true
+	}
+	//the names are fixed, so are the keys of every server
+	if len(servers) != 3 {
+		t.Fatalf("keys went to servers %v, want all of them", servers)
+	}
+}
+
+//a batch the breakers reject never reaches the server and tells nothing about it
+func TestBatchRejected(t *testing.T) {
+	var bad int32
+	c := newTestClient(t, flakyServer(t, &bad), WithBreaker(testBreaker))
+	tripBreaker(t, c, &bad)
+	ep := c.getEndpoints()[0]
+	ep.mu.Lock()
+	ep.failures = 2
+	ep.mu.Unlock()
+	calls := []*BatchCall{{Name: "Get", Req: addReq{}, Res: &addRes{}}}
+	if err := ep.callBatch(context.Background(), calls); err != nil || calls[0].Err != ErrCircuitOpen {
+		t.Fatalf("got %v and %v, want circuit open", err, calls[0].Err)
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.failures != 2 {
+		t.Fatalf("failures of the endpoint reset to %d", ep.failures)
+	}
+}
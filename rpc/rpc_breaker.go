@@ -0,0 +1,251 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+var ErrCircuitOpen = errors.New("rpc_client: circuit open, call not sent")
+
+//when calls of a method on a server stop being sent. the breaker of each
+//method and server counts the calls in a window, trips open when too many
+//fail or are slow, fails the calls fast while open, then lets a few calls
+//through half-open and closes again when they succeed.
+type BreakerPolicy struct {
+	Methods     []string      //methods guarded, empty means all
+	Window      time.Duration //calls are counted in windows this long, 10s when 0
+	MinRequests int           //calls in the window before it may trip, 20 when 0
+	ErrorRate   float64       //share of failed calls which trips it, 0.5 when 0
+	SlowCall    time.Duration //calls taking longer are slow, 0 means none are
+	SlowRate    float64       //share of slow calls which trips it, 0.5 when 0
+	OpenFor     time.Duration //how long it stays open, 5s when 0
+	Probes      int           //calls let through half-open, all must succeed, 1 when 0
+}
+
+//guard the calls with circuit breakers
+func WithBreaker(p BreakerPolicy) Option {
+	return func(o *options) {
+		p = p.normalize()
+		o.breaker = &p
+	}
+}
+
+//fill the zero fields of the policy
+func (p BreakerPolicy) normalize() BreakerPolicy {
+	if p.Window <= 0 {
+		p.Window = 10 * time.Second
+	}
+	if p.MinRequests <= 0 {
+		p.MinRequests = 20
+	}
+	if p.ErrorRate <= 0 {
+		p.ErrorRate = 0.5
+	}
+	if p.SlowRate <= 0 {
+		p.SlowRate = 0.5
+	}
+	if p.OpenFor <= 0 {
+		p.OpenFor = 5 * time.Second
+	}
+	if p.Probes <= 0 {
+		p.Probes = 1
+	}
+	return p
+}
+
+//state of a breaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota //calls are sent
+	BreakerOpen                         //calls fail fast
+	BreakerHalfOpen                     //a few calls test the server
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+//circuit breaker of one method on one server
+type breaker struct {
+	p *BreakerPolicy
+
+	mu          sync.Mutex //protect the fields below
+	state       BreakerState
+	windowStart time.Time
+	calls       int
+	failures    int
+	slow        int
+	openedAt    time.Time
+	probes      int //calls let through half-open and not finished
+	passed      int //half-open calls which succeeded
+}
+
+//breaker of method on the endpoint, nil when the method isn't guarded
+func (ep *endpoint) breaker(method string) *breaker {
+	p := ep.opts.breaker
+	if p == nil || (len(p.Methods) > 0 && !containsString(p.Methods, method)) {
+		return nil
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	b, ok := ep.breakers[method]
+	if !ok {
+		if ep.breakers == nil {
+			ep.breakers = make(map[string]*breaker)
+		}
+		b = &breaker{p: p, windowStart: time.Now()}
+		ep.breakers[method] = b
+	}
+	return b
+}
+
+//state now, an open breaker turns half-open after OpenFor. called with b.mu held
+func (b *breaker) current(now time.Time) BreakerState {
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.p.OpenFor {
+		b.state = BreakerHalfOpen
+		b.probes, b.passed = 0, 0
+	}
+	return b.state
+}
+
+//whether calls may be sent, without taking a half-open probe
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.current(time.Now()) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.probes < b.p.Probes
+	}
+	return true
+}
+
+//ask to send one call, every allowed call must be followed by done
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.current(time.Now()) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= b.p.Probes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+//record the outcome of an allowed call
+func (b *breaker) done(method string, ep *endpoint, err error, took time.Duration) {
+	if b == nil {
+		return
+	}
+	failed := breakerFailure(err)
+	slow := b.p.SlowCall > 0 && took > b.p.SlowCall
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		//the caller went away, the call tells nothing about the server
+		if b.state == BreakerHalfOpen && b.probes > 0 {
+			b.probes--
+		}
+		return
+	}
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			b.open(now, method, ep)
+			return
+		}
+		b.passed++
+		if b.passed >= b.p.Probes {
+			b.state = BreakerClosed
+			b.reset(now)
+			log.InfoLog("rpc_client: circuit of %s on %s closed", method, ep.addr)
+		}
+		return
+	case BreakerOpen:
+		//a call sent before it opened
+		return
+	}
+	if now.Sub(b.windowStart) >= b.p.Window {
+		b.reset(now)
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if slow {
+		b.slow++
+	}
+	if b.calls < b.p.MinRequests {
+		return
+	}
+	if float64(b.failures) >= b.p.ErrorRate*float64(b.calls) || (b.p.SlowCall > 0 && float64(b.slow) >= b.p.SlowRate*float64(b.calls)) {
+		b.open(now, method, ep)
+	}
+}
+
+//trip the breaker, called with b.mu held
+func (b *breaker) open(now time.Time, method string, ep *endpoint) {
+	log.ErrorLog("rpc_client: circuit of %s on %s open for %s. calls:%d failures:%d slow:%d", method, ep.addr, b.p.OpenFor, b.calls, b.failures, b.slow)
+	b.state = BreakerOpen
+	b.openedAt = now
+	b.reset(now)
+}
+
+//start a new window, called with b.mu held
+func (b *breaker) reset(now time.Time) {
+	b.windowStart = now
+	b.calls, b.failures, b.slow = 0, 0, 0
+}
+
+//states of the breakers of the endpoint by method
+func (ep *endpoint) breakerStates() map[string]BreakerState {
+	ep.mu.Lock()
+	bs := make(map[string]*breaker, len(ep.breakers))
+	for m, b := range ep.breakers {
+		bs[m] = b
+	}
+	ep.mu.Unlock()
+	states := make(map[string]BreakerState, len(bs))
+	now := time.Now()
+	for m, b := range bs {
+		b.mu.Lock()
+		states[m] = b.current(now)
+		b.mu.Unlock()
+	}
+	return states
+}
+
+//errors which tell the server is in trouble, mistakes of the caller don't count
+func breakerFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code == CodeInternal || e.Code == CodeUnavailable || e.Code == CodeUnknown
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//server whose "Get" fails while bad is 1 and takes A milliseconds otherwise
+func flakyServer(t *testing.T, bad *int32) string {
+	s := NewServer()
+	RegisterFunc(s, "Get", func(ctx context.Context, r addReq) (addRes, error) {
+		if atomic.LoadInt32(bad) == 1 {
+			return addRes{}, Errorf(CodeInternal, "db down")
+		}
+		select {
+		case <-time.After(time.Duration(r.A) * time.Millisecond):
+		case <-ctx.Done():
+		}
+		return addRes{1}, nil
+	})
+	return serve(t, s)
+}
+
+func breakerState(c *Client) BreakerState {
+	return c.EndpointStats()[0].Breakers["Get"]
+}
+
+//fail MinRequests calls so the breaker opens
+func tripBreaker(t *testing.T, c *Client, bad *int32) {
+	t.Helper()
+	atomic.StoreInt32(bad, 1)
+	for i := 0; i < 4; i++ {
+		if err := c.Call("Get", addReq{}, &addRes{}); !errors.Is(err, ErrInternal) {
+			t.Fatal(i, err)
+		}
+	}
+	atomic.StoreInt32(bad, 0)
+	if err := c.Call("Get", addReq{}, &addRes{}); err != ErrCircuitOpen {
+		t.Fatalf("got %v, want circuit open", err)
+	}
+}
+
+var testBreaker = BreakerPolicy{MinRequests: 4, OpenFor: 100 * time.Millisecond, SlowCall: 20 * time.Millisecond, Methods: []string{"Get"}}
+
+func TestBreakerErrors(t *testing.T) {
+	var bad int32
+	c := newTestClient(t, flakyServer(t, &bad), WithBreaker(testBreaker))
+	tripBreaker(t, c, &bad)
+	time.Sleep(120 * time.Millisecond)
+	//the probe succeeds and closes it
+	if err := c.Call("Get", addReq{}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	if st := breakerState(c); st != BreakerClosed {
+		t.Fatalf("breaker %s after a good probe", st)
+	}
+}
+
+func TestBreakerSlowCalls(t *testing.T) {
+	var bad int32
+	c := newTestClient(t, flakyServer(t, &bad), WithBreaker(testBreaker))
+	for i := 0; i < 4; i++ {
+		c.Call("Get", addReq{A: 30}, &addRes{})
+	}
+	if err := c.Call("Get", addReq{}, &addRes{}); err != ErrCircuitOpen {
+		t.Fatalf("got %v, want circuit open", err)
+	}
+	time.Sleep(120 * time.Millisecond)
+	//a slow probe opens it again
+	c.Call("Get", addReq{A: 30}, &addRes{})
+	if err := c.Call("Get", addReq{}, &addRes{}); err != ErrCircuitOpen {
+		t.Fatalf("got %v, want circuit open", err)
+	}
+}
+
+func TestBreakerCanceledProbe(t *testing.T) {
+	var bad int32
+	c := newTestClient(t, flakyServer(t, &bad), WithBreaker(testBreaker))
+	tripBreaker(t, c, &bad)
+	time.Sleep(120 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := c.CallContext(ctx, "Get", addReq{A: 1000}, &addRes{}); err != context.Canceled {
+		t.Fatalf("got %v, want canceled", err)
+	}
+	//the probe told nothing, the next call probes again
+	if st := breakerState(c); st != BreakerHalfOpen {
+		t.Fatalf("breaker %s after a canceled probe", st)
+	}
+	if err := c.Call("Get", addReq{}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	if st := breakerState(c); st != BreakerClosed {
+		t.Fatalf("breaker %s after a good probe", st)
+	}
+}
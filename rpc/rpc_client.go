@@ -1,146 +1,434 @@
 package rpc
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
-	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClientClosed = errors.New("rpc_client: client is closed")
 
-	"GoUserManaSys/utils"
+	//the server is shutting down and takes no more requests on the connection
+	errGoAway = errors.New("server is going away")
+	//the resolver dropped the server the call picked
+	errRetired = errors.New("server is removed")
 )
 
-//rpc client,contains pool
+//rpc client of one or more servers, each with a pool of multiplexed connections
 type Client struct {
-	pool chan net.TCPConn
+	opts options
+	stop chan struct{} //closed by Close, stops the background loops
+
+	mu        sync.Mutex //protect the fields below
+	endpoints []*endpoint
+	closed    bool
+	subs      map[string][]*Subscription //subscriptions by topic
+	kick      chan struct{}              //wake the push loop
+}
+
+//error of a call whose connection failed
+type ConnError struct {
+	Err  error
+	Sent bool //the request went out, the server may have run it
+}
+
+func (e *ConnError) Error() string {
+	return "rpc_client: " + e.Err.Error()
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+//one connection to the server, carries many in-flight calls
+type clientConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	wMu  sync.Mutex //serialize the writes of concurrent calls
+
+	maxFrame     uint32      //biggest frame body this side accepts
+	peerMaxFrame uint32      //biggest frame body the server accepts
+	codecs       []string    //codecs offered to the server
+	codec        Codec       //codec the server picked
+	auth         *Keyring    //keys to answer the challenge of the server
+	compressors  []string    //compressors offered to the server
+	compress     compression //compressor the server picked, set before the responses are read
+	threshold    int         //bodies from this size on are compressed
+
+	mu       sync.Mutex               //protect the fields below
+	seq      uint64                   //last used request id
+	pending  map[uint64]chan *frame   //calls waiting for their response
+	streams  map[uint64]*ClientStream //open streams by id
+	push     func(*frame)             //handler of push frames, only on subscription connections
+	err      error                    //set once the connection is broken
+	draining bool                     //the server said go away, no new calls
+
+	inFlight int       //calls holding the connection, guarded by endpoint.mu
+	lastUsed time.Time //when the last call gave it back, guarded by endpoint.mu
 }
 
-//client creat n connections connect to address
-func NewClient(n int, add string) (Client, error) {
-	//parse tcp server address
-	tAddr, err := net.ResolveTCPAddr("tcp4", add)
+//client of the server at address, with a pool of at most n connections.
+//connections are dialed when calls need them, WithPool sets the rest of the pool.
+func NewClient(n int, add string, opts ...Option) (*Client, error) {
+	return NewMultiClient(n, []string{add}, opts...)
+}
+
+//client of several servers which serve the same methods, each with a pool
+//of at most n connections. the balancer chooses the server of every call.
+func NewMultiClient(n int, addrs []string, opts ...Option) (*Client, error) {
+	return NewResolverClient(n, StaticResolver(addrs...), opts...)
+}
+
+//client of the servers the resolver finds, each with a pool of at most n
+//connections. the resolver is asked again every resolve interval.
+func NewResolverClient(n int, r Resolver, opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	o.pool = o.pool.normalize(n)
+	o.eject = o.eject.normalize()
+	if o.balancer == nil {
+		o.balancer = RoundRobin()
+	}
+	if o.resolveInterval <= 0 {
+		o.resolveInterval = defaultResolveInterval
+	}
+	addrs, err := resolve(r)
 	if err != nil {
-		return Client{}, err
+		return nil, err
 	}
-	//creat connections and save to pool
-	newPool := make(chan net.TCPConn, n)
-	for i := 0; i < n; i++ {
-		connect, err := net.DialTCP("tcp4", nil, tAddr)
-		if err != nil {
-			return Client{}, errors.New("rpc_client:init failed")
-		}
-		newPool <- *connect
+	if len(addrs) == 0 {
+		return nil, errors.New("rpc_client: no server address")
+	}
+	c := &Client{opts: o, stop: make(chan struct{})}
+	added, err := c.setEndpoints(addrs)
+	if err != nil {
+		return nil, err
+	}
+	//a server which is down now is dialed again by the calls
+	for _, ep := range added {
+		ep.fill()
 	}
-	//fmt.Printf("rpc_client:init success...")
-	return Client{pool: newPool}, nil
+	if _, static := r.(staticResolver); !static {
+		go c.watch(r)
+	}
+	if c.opts.heartbeat > 0 {
+		go c.health()
+	}
+	if c.opts.pool.IdleTimeout > 0 {
+		go c.shrink()
+	}
+	return c, nil
 }
 
-// close pool
-func (c *Client) Close() {
-	close(c.pool)
-	for cn := range c.pool {
-		cn.Close()
-		//fmt.Println("close conn")
-	}
+//servers of the client now
+func (c *Client) getEndpoints() []*endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.endpoints
 }
 
-//caller use Call function to connect server
-func (c *Client) Call(name string, req interface{}, res interface{}) error {
-	//get an idle conn
-	connect := c.getC()
-	//put conn to pool
-	defer c.putC(connect)
-	//pack the request
-	reqJ, err := c.packReq(name, req)
-	if err != nil {
-		return err
+//say hello to the server within ctx and start the reader of the connection
+func newClientConn(ctx context.Context, conn net.Conn, o options) (*clientConn, error) {
+	cc := &clientConn{
+		conn:        conn,
+		r:           bufio.NewReader(conn),
+		maxFrame:    o.maxFrameSize,
+		codecs:      o.codecs,
+		auth:        o.auth,
+		compressors: o.compressors,
+		threshold:   o.compressThreshold,
+		pending:     make(map[uint64]chan *frame),
+		streams:     make(map[uint64]*ClientStream),
 	}
-	//send data to server
-	//handle err
-	connect.Write(reqJ)
+	if err := cc.handshake(ctx); err != nil {
+		return nil, err
+	}
+	go cc.read()
+	return cc, nil
+}
 
-	dL := make([]byte, TcpHeadMaxSize)
-	n, err := connect.Read(dL)
-	if err != io.EOF && err != nil {
-		return err
+//send the hello and learn the version, frame size and codec the server accepts
+func (cc *clientConn) handshake(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
 	}
-	if n <= 0 {
-		return errors.New("rpc_client: no data")
+	cc.conn.SetDeadline(deadline)
+	defer cc.conn.SetDeadline(time.Time{})
+	//a ctx canceled before its deadline breaks off the reads and writes too
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			cc.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	if len(cc.codecs) == 0 {
+		cc.codecs = []string{JSONCodec{}.Name()}
 	}
-	//convert dL to 64 bitSize, save to len
-	l, err := strconv.ParseInt(string(dL[:TcpHeadMaxSize]), 10, 64)
+	f, err := helloFrame(hello{Version: frameVersion, MaxFrameSize: cc.maxFrame, Codecs: cc.codecs, Compressors: cc.compressors})
 	if err != nil {
-		return nil
+		return err
 	}
-	//make b size buffer to accept response data
-	b := make([]byte, l)
-	//read data and save to b
-	n, err = connect.Read(b)
-	if err != io.EOF && err != nil {
+	if err = writeFrame(cc.conn, f); err != nil {
 		return err
 	}
-	if n <= 0 {
-		return errors.New("rpc_client: no data")
+	f, err = readFrame(cc.r, cc.maxFrame)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadHandshake, err)
 	}
-	//parse json data and save to res
-	err = c.unpackRes(res, b)
+	h, err := parseHello(f)
 	if err != nil {
 		return err
 	}
+	codec, ok := GetCodec(h.Codec)
+	if !ok || !containsString(cc.codecs, h.Codec) {
+		return ErrNoCodec
+	}
+	var comp Compressor
+	if h.Compressor != "" {
+		if comp, ok = GetCompressor(h.Compressor); !ok || !containsString(cc.compressors, h.Compressor) {
+			return fmt.Errorf("%w: server picked compressor %q", ErrBadHandshake, h.Compressor)
+		}
+	}
+	cc.peerMaxFrame = h.MaxFrameSize
+	cc.codec = codec
+	if h.Nonce != nil {
+		if err = cc.authenticate(h.Nonce); err != nil {
+			return err
+		}
+	}
+	//the auth frames are never compressed
+	if comp != nil {
+		cc.compress = compression{c: comp, threshold: cc.threshold}
+	}
 	return nil
 }
 
-//get an idle conn and return
-func (c *Client) getC() (connect net.TCPConn) {
-	select {
-	case connect := <-c.pool:
-		return connect
+// close pool
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	for _, ep := range c.endpoints {
+		ep.close()
 	}
 }
 
-//put the conn to pool
-func (c *Client) putC(Connect net.TCPConn) {
-	select {
-	case c.pool <- Connect:
-		return
+//caller use Call function to connect server
+func (c *Client) Call(name string, req interface{}, res interface{}) error {
+	return c.CallContext(context.Background(), name, req, res)
+}
+
+//call the server and give up when ctx is done. the time left before the
+//deadline of ctx is sent along, so the server can skip expired work.
+//the call goes through the client interceptors and is retried by the retry policy.
+func (c *Client) CallContext(ctx context.Context, name string, req interface{}, res interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	if len(c.opts.interceptors) == 0 {
+		return c.invokeRetry(ctx, name, req, res)
+	}
+	return chainClient(c.opts.interceptors, c.invokeRetry)(ctx, name, req, res)
 }
 
-//pack the request
-func (c *Client) packReq(name string, f interface{}) ([]byte, error) {
-	data, err := json.Marshal(f)
+//one attempt of the call
+func (c *Client) invoke(ctx context.Context, name string, req interface{}, res interface{}) error {
+	ep, err := c.pick(name, req)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req := Request{ReqName: name, ReqData: data}
-	request, err := toJsons(req)
-	if err != nil {
-		return nil, err
+	b := ep.breaker(name)
+	if !b.allow() {
+		return ErrCircuitOpen
 	}
-	return request, nil
+	start := time.Now()
+	err = ep.invoke(ctx, name, req, res)
+	ep.report(err)
+	b.done(name, ep, err, time.Since(start))
+	return err
 }
 
-//unpack the response data
-func (c *Client) unpackRes(resI interface{}, resB []byte) error {
-	err := json.Unmarshal(resB, resI)
+//send the call to the server of the endpoint
+func (ep *endpoint) invoke(ctx context.Context, name string, req interface{}, res interface{}) error {
+	cc, err := ep.getConn(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer ep.release(cc)
+	resp, err := cc.call(ctx, name, req)
+	if err != nil {
+		return err
+	}
+	if resp.flags&flagError != 0 {
+		return decodeError(resp.body)
+	}
+	//parse the data and save to res
+	return cc.codec.Unmarshal(resp.body, res)
+}
+
+//send the request and wait for the response with the same id
+func (cc *clientConn) call(ctx context.Context, name string, req interface{}) (*frame, error) {
+	data, err := cc.codec.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	//pack the request
+	r := Request{ReqName: name, ReqData: data}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		r.Timeout = int64(time.Until(deadline))
+		if r.Timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	body := encodeRequest(r)
+	if uint32(len(body)) > cc.peerMaxFrame {
+		return nil, ErrFrameTooBig
+	}
+	return cc.roundTrip(ctx, kindRequest, body)
+}
+
+//send a frame of kind and wait for the answer with the same id
+func (cc *clientConn) roundTrip(ctx context.Context, kind uint8, body []byte) (*frame, error) {
+	deadline, _ := ctx.Deadline()
+	ch := make(chan *frame, 1)
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, &ConnError{Err: cc.err}
+	}
+	if cc.draining {
+		cc.mu.Unlock()
+		return nil, &ConnError{Err: errGoAway}
+	}
+	cc.seq++
+	id := cc.seq
+	cc.pending[id] = ch
+	cc.mu.Unlock()
+
+	if err := cc.write(&frame{kind: kind, id: id, body: body}, deadline); err != nil {
+		cc.forget(id)
+		//a deadline hit while writing belongs to the caller
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &ConnError{Err: err}
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			//the reader closed the channel, the connection is broken
+			cc.mu.Lock()
+			defer cc.mu.Unlock()
+			return nil, &ConnError{Err: cc.err, Sent: true}
+		}
+		return resp, nil
+	case <-ctx.Done():
+		cc.forget(id)
+		return nil, ctx.Err()
+	}
 }
 
-//rcp client re-call
-func (c *Client) ReCall(name string, req interface{}, res interface{}) error {
-	fmt.Println("Disconnected, re-establishing connection...")
-	//close pool
-	c.Close()
-	//re-creat rpc client
-	cli, err := NewClient(utils.ClientPoolSize, utils.ServerPort)
+//write a whole frame, a zero deadline means no deadline
+func (cc *clientConn) write(f *frame, deadline time.Time) error {
+	f = cc.compress.pack(f)
+	cc.wMu.Lock()
+	defer cc.wMu.Unlock()
+	cc.conn.SetWriteDeadline(deadline)
+	err := writeFrame(cc.conn, f)
 	if err != nil {
-		fmt.Println(err)
+		//a partly written frame breaks the stream, drop the connection
+		cc.conn.Close()
 	}
-	fmt.Println("Successfully re-established connection...")
-	err = cli.Call(name, req, &res)
 	return err
 }
+
+//whether the connection can't be used any more
+func (cc *clientConn) broken() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err != nil || cc.draining
+}
+
+//stop waiting for the response of id
+func (cc *clientConn) forget(id uint64) {
+	cc.mu.Lock()
+	delete(cc.pending, id)
+	cc.mu.Unlock()
+}
+
+//read the responses and hand them to the waiting calls
+func (cc *clientConn) read() {
+	var err error
+	for {
+		var f *frame
+		f, err = readFrame(cc.r, cc.maxFrame)
+		if err == nil {
+			err = cc.compress.unpack(f, cc.maxFrame)
+		}
+		if err != nil {
+			break
+		}
+		if f.kind == kindGoAway {
+			//calls already sent are still answered, new ones go to other connections
+			cc.mu.Lock()
+			cc.draining = true
+			cc.mu.Unlock()
+		} else if f.kind == kindStreamData || f.kind == kindStreamWindow || f.kind == kindStreamEnd {
+			cc.streamFrame(f)
+		} else if f.kind == kindPush {
+			cc.mu.Lock()
+			push := cc.push
+			cc.mu.Unlock()
+			if push != nil {
+				push(f)
+			}
+			continue
+		} else if f.kind != kindResponse && f.kind != kindPong {
+			err = fmt.Errorf("unexpected frame kind %d", f.kind)
+			break
+		}
+		cc.mu.Lock()
+		ch, ok := cc.pending[f.id]
+		delete(cc.pending, f.id)
+		done := cc.draining && len(cc.pending) == 0 && len(cc.streams) == 0
+		cc.mu.Unlock()
+		if ok {
+			ch <- f
+		}
+		if done {
+			err = errGoAway
+			break
+		}
+	}
+	//connection broken, fail all the waiting calls
+	cc.conn.Close()
+	cc.mu.Lock()
+	cc.err = fmt.Errorf("connection broken: %v", err)
+	for id, ch := range cc.pending {
+		close(ch)
+		delete(cc.pending, id)
+	}
+	for id, cs := range cc.streams {
+		cs.fail(&ConnError{Err: cc.err, Sent: true})
+		delete(cc.streams, id)
+	}
+	cc.mu.Unlock()
+}
@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type addReq struct{ A, B int }
+type addRes struct{ Sum int }
+type nameReq struct{ Name string }
+
+func add(ctx context.Context, r addReq) (addRes, error) {
+	return addRes{r.A + r.B}, nil
+}
+
+//serve s on a local port until the test ends and return its address
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return l.Addr().String()
+}
+
+//client of addr with two connections, closed when the test ends
+func newTestClient(t *testing.T, addr string, opts ...Option) *Client {
+	t.Helper()
+	c, err := NewClient(2, addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestMultiplex(t *testing.T) {
+	s := NewServer()
+	//later requests often finish first, so responses come back out of order
+	RegisterFunc(s, "Add", func(ctx context.Context, r addReq) (addRes, error) {
+		time.Sleep(time.Duration(r.A%3) * time.Millisecond)
+		return addRes{r.A + r.B}, nil
+	})
+	c := newTestClient(t, serve(t, s))
+	var wg sync.WaitGroup
+	for i := 0; i < 2000; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var res addRes
+			if err := c.Call("Add", addReq{i, 1}, &res); err != nil || res.Sum != i+1 {
+				t.Errorf("call %d: sum %d, err %v", i, res.Sum, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if st := c.Stats(); st.Open > 2 {
+		t.Fatalf("%d connections open, want at most 2", st.Open)
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	s := NewServer()
+	canceled := make(chan struct{})
+	RegisterFunc(s, "Slow", func(ctx context.Context, r addReq) (addRes, error) {
+		select {
+		case <-ctx.Done():
+			close(canceled)
+			return addRes{}, ctx.Err()
+		case <-time.After(time.Duration(r.A) * time.Millisecond):
+			return addRes{r.A}, nil
+		}
+	})
+	c := newTestClient(t, serve(t, s))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.CallContext(ctx, "Slow", addReq{A: 5000}, &addRes{}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	//the server got the deadline with the request
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not canceled")
+	}
+	//the connection is still usable
+	var res addRes
+	if err := c.Call("Slow", addReq{A: 1}, &res); err != nil || res.Sum != 1 {
+		t.Fatal(err)
+	}
+}
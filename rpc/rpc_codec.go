@@ -0,0 +1,377 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+//codec turns request and response structs into frame bodies and back.
+//the codec of a connection is chosen in the handshake.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecMu sync.RWMutex
+	codecs  = map[string]Codec{}
+
+	ErrNoCodec = errors.New("rpc: no common codec")
+)
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(GobCodec{})
+	RegisterCodec(BinaryCodec{})
+}
+
+//make a codec available to servers and clients by its name
+func RegisterCodec(c Codec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+//get a registered codec
+func GetCodec(name string) (Codec, bool) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+//pick the first codec of the client's preference list the server allows,
+//an empty allowed list means every registered codec
+func chooseCodec(prefer []string, allowed []string) (Codec, error) {
+	for _, name := range prefer {
+		if len(allowed) > 0 && !containsString(allowed, name) {
+			continue
+		}
+		if c, ok := GetCodec(name); ok {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCodec
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+//encoding/json codec, used by old clients too
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                               { return "json" }
+func (JSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+//encoding/gob codec, every body carries its own type information
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+//compact binary codec. struct fields are written in declaration order
+//without names, so both sides must use the same struct definition:
+//bool 1 byte, ints zigzag varint, uints varint, floats fixed 4/8 bytes,
+//string, []byte, slices and maps start with a varint length,
+//pointers start with a 0/1 nil byte. interfaces and channels are not supported.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string { return "binary" }
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	//like json, a pointer to the value encodes the same as the value
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	e := binEncoder{}
+	if err := e.encode(rv); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("rpc: binary codec needs a non-nil pointer")
+	}
+	d := binDecoder{buf: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if len(d.buf) != 0 {
+		return errors.New("rpc: binary codec: trailing data")
+	}
+	return nil
+}
+
+var errShortBuffer = errors.New("rpc: binary codec: short buffer")
+
+type binEncoder struct {
+	buf []byte
+}
+
+func (e *binEncoder) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *binEncoder) varint(x int64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(b[:], x)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *binEncoder) fixed(x uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], x)
+	e.buf = append(e.buf, b[8-size:]...)
+}
+
+func (e *binEncoder) encode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.varint(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.uvarint(v.Uint())
+	case reflect.Float32:
+		e.fixed(uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.fixed(math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.uvarint(uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.uvarint(uint64(v.Len()))
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		e.uvarint(uint64(v.Len()))
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
+		e.buf = append(e.buf, 1)
+		return e.encode(v.Elem())
+	case reflect.Invalid:
+		return errors.New("rpc: binary codec: can't encode nil")
+	default:
+		return fmt.Errorf("rpc: binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+type binDecoder struct {
+	buf []byte
+}
+
+func (d *binDecoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		return 0, errShortBuffer
+	}
+	d.buf = d.buf[n:]
+	return x, nil
+}
+
+//read a length and check enough bytes are left for it
+func (d *binDecoder) length() (int, error) {
+	l, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if l > uint64(len(d.buf)) {
+		return 0, errShortBuffer
+	}
+	return int(l), nil
+}
+
+func (d *binDecoder) next(n int) ([]byte, error) {
+	if n > len(d.buf) {
+		return nil, errShortBuffer
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *binDecoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, n := binary.Varint(d.buf)
+		if n <= 0 {
+			return errShortBuffer
+		}
+		d.buf = d.buf[n:]
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		v.SetUint(x)
+	case reflect.Float32:
+		b, err := d.next(4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))))
+	case reflect.Float64:
+		b, err := d.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	case reflect.String:
+		l, err := d.length()
+		if err != nil {
+			return err
+		}
+		b, _ := d.next(l)
+		v.SetString(string(b))
+	case reflect.Slice:
+		l, err := d.length()
+		if err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, _ := d.next(l)
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		//every element takes at least one byte, so l is bounded by the body size
+		s := reflect.MakeSlice(v.Type(), l, l)
+		for i := 0; i < l; i++ {
+			if err = d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		l, err := d.length()
+		if err != nil {
+			return err
+		}
+		t := v.Type()
+		m := reflect.MakeMapWithSize(t, l)
+		for i := 0; i < l; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err = d.decode(key); err != nil {
+				return err
+			}
+			val := reflect.New(t.Elem()).Elem()
+			if err = d.decode(val); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, val)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		p := reflect.New(v.Type().Elem())
+		if err = d.decode(p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+	default:
+		return fmt.Errorf("rpc: binary codec: unsupported type %s", v.Type())
+	}
+	return nil
+}
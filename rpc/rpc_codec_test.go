@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"GoUserManaSys/utils"
+)
+
+type codecInner struct {
+	F float64
+	P *int
+}
+
+type codecAll struct {
+	B  bool
+	I  int
+	N  int8
+	U  uint32
+	F  float32
+	S  string
+	Bs []byte
+	L  []codecInner
+	M  map[string]int
+	A  [2]string
+	p  int
+}
+
+var codecNames = []string{"json", "gob", "binary"}
+
+func TestCodecRoundTrip(t *testing.T) {
+	x := 5
+	want := codecAll{true, -7, -3, 9, 1.5, "héllo", []byte{1, 2}, []codecInner{{2.5, &x}, {F: 1}}, map[string]int{"a": 1}, [2]string{"x", "y"}, 0}
+	for _, name := range codecNames {
+		c, ok := GetCodec(name)
+		if !ok {
+			t.Fatalf("codec %s not registered", name)
+		}
+		b, err := c.Marshal(&want)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var got codecAll
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %+v", name, got)
+		}
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", add)
+	addr := serve(t, s)
+	for _, name := range codecNames {
+		c := newTestClient(t, addr, WithCodecs(name), WithPool(PoolConfig{MinConns: 1}))
+		var res addRes
+		if err := c.Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+			t.Fatal(name, err)
+		}
+		if got := c.endpoints[0].conns[0].codec.Name(); got != name {
+			t.Fatalf("connection speaks %s, want %s", got, name)
+		}
+	}
+	//a server which accepts json only
+	s2 := NewServer(WithCodecs("json"))
+	RegisterFunc(s2, "Add", add)
+	addr2 := serve(t, s2)
+	//the server hangs up on clients without a common codec
+	if err := newTestClient(t, addr2, WithCodecs("binary")).Call("Add", addReq{}, &addRes{}); err == nil {
+		t.Fatal("call without a common codec succeeded")
+	}
+	c := newTestClient(t, addr2, WithCodecs("binary", "json"), WithPool(PoolConfig{MinConns: 1}))
+	if got := c.endpoints[0].conns[0].codec.Name(); got != "json" {
+		t.Fatalf("connection speaks %s, want json", got)
+	}
+}
+
+//the request and response types of tcpserver go through every codec
+func TestCodecPact(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "GetInfo", func(ctx context.Context, r utils.ReqGetInfo) (utils.ResGetInfo, error) {
+		return utils.ResGetInfo{Code: utils.Success, UserName: r.UserName, NickName: "nick"}, nil
+	})
+	addr := serve(t, s)
+	for _, name := range codecNames {
+		var res utils.ResGetInfo
+		err := newTestClient(t, addr, WithCodecs(name)).Call("GetInfo", utils.ReqGetInfo{UserName: "bob"}, &res)
+		if err != nil || res.UserName != "bob" || res.NickName != "nick" || res.Code != utils.Success {
+			t.Fatal(name, err, res)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//bodies from this size on are compressed when WithCompression gets no threshold
+const DefaultCompressThreshold = 1024
+
+//compressor shrinks frame bodies. the compressor of a connection is chosen
+//in the handshake, bodies it shrank carry flagCompressed.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	//decompress data, results bigger than max are refused
+	Decompress(data []byte, max int) ([]byte, error)
+}
+
+var (
+	compressorMu sync.RWMutex
+	compressors  = map[string]Compressor{}
+
+	ErrNoCompressor = errors.New("rpc: compressed frame on a connection without compression")
+)
+
+func init() {
+	RegisterCompressor(FlateCompressor{})
+	RegisterCompressor(GzipCompressor{})
+}
+
+//make a compressor available to servers and clients by its name
+func RegisterCompressor(c Compressor) {
+	compressorMu.Lock()
+	defer compressorMu.Unlock()
+	compressors[c.Name()] = c
+}
+
+//get a registered compressor
+func GetCompressor(name string) (Compressor, bool) {
+	compressorMu.RLock()
+	defer compressorMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+//compress bodies from threshold bytes on, 0 means DefaultCompressThreshold.
+//a client offers the compressors in this order, a server accepts only
+//these. no names means flate, then gzip.
+func WithCompression(threshold int, names ...string) Option {
+	return func(o *options) {
+		if threshold <= 0 {
+			threshold = DefaultCompressThreshold
+		}
+		if len(names) == 0 {
+			names = []string{FlateCompressor{}.Name(), GzipCompressor{}.Name()}
+		}
+		o.compressThreshold = threshold
+		o.compressors = names
+	}
+}
+
+//pick the first compressor of the client's list the server accepts, nil
+//when there is none and the connection stays uncompressed
+func chooseCompressor(prefer []string, allowed []string) Compressor {
+	for _, name := range prefer {
+		if !containsString(allowed, name) {
+			continue
+		}
+		if c, ok := GetCompressor(name); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+//compression of one connection, the zero value compresses nothing
+type compression struct {
+	c         Compressor
+	threshold int
+}
+
+//the frame to write: f itself, or a copy with the compressed body when that
+//is smaller. f may be shared, so it is never changed.
+func (cp compression) pack(f *frame) *frame {
+	if cp.c == nil || len(f.body) < cp.threshold || f.flags&flagCompressed != 0 {
+		return f
+	}
+	b, err := cp.c.Compress(f.body)
+	if err != nil || len(b) >= len(f.body) {
+		return f
+	}
+	return &frame{version: f.version, kind: f.kind, flags: f.flags | flagCompressed, id: f.id, body: b}
+}
+
+//decompress the body of a read frame in place
+func (cp compression) unpack(f *frame, max uint32) error {
+	if f.flags&flagCompressed == 0 {
+		return nil
+	}
+	if cp.c == nil {
+		return ErrNoCompressor
+	}
+	b, err := cp.c.Decompress(f.body, int(max))
+	if err != nil {
+		return err
+	}
+	f.body = b
+	f.flags &^= flagCompressed
+	return nil
+}
+
+//read r up to max bytes
+func readLimited(r io.Reader, max int) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > int64(max) {
+		return nil, ErrFrameTooBig
+	}
+	return buf.Bytes(), nil
+}
+
+//deflate at the best speed, the fast one for busy connections
+type FlateCompressor struct{}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+func (FlateCompressor) Name() string { return "flate" }
+
+func (FlateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (FlateCompressor) Decompress(data []byte, max int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	b, err := readLimited(r, max)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: flate body: %w", err)
+	}
+	return b, nil
+}
+
+//gzip at the default level, smaller bodies for slow links
+type GzipCompressor struct{}
+
+var gzipWriters = sync.Pool{New: func() interface{} {
+	return gzip.NewWriter(nil)
+}}
+
+func (GzipCompressor) Name() string { return "gzip" }
+
+func (GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GzipCompressor) Decompress(data []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("rpc: gzip body: %w", err)
+	}
+	defer r.Close()
+	b, err := readLimited(r, max)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: gzip body: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,85 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	big := strings.Repeat("abcdefgh", 40000)
+	for _, c := range []Compressor{FlateCompressor{}, GzipCompressor{}} {
+		cp := compression{c: c, threshold: 10}
+		f := &frame{kind: kindRequest, id: 3, body: []byte(big)}
+		p := cp.pack(f)
+		if p.flags&flagCompressed == 0 || len(p.body) > len(big)/10 {
+			t.Fatalf("%s: %d bytes packed", c.Name(), len(p.body))
+		}
+		//the frame may be shared, it stays as it was
+		if f.flags != 0 || len(f.body) != len(big) {
+			t.Fatalf("%s changed the frame", c.Name())
+		}
+		if err := cp.unpack(p, 1000); !errors.Is(err, ErrFrameTooBig) {
+			t.Fatalf("%s: got %v, want frame too big", c.Name(), err)
+		}
+		p = cp.pack(f)
+		if err := cp.unpack(p, 1<<20); err != nil || string(p.body) != big || p.flags != 0 || p.id != 3 {
+			t.Fatalf("%s: %v", c.Name(), err)
+		}
+	}
+	cp := compression{c: FlateCompressor{}, threshold: 10}
+	//small bodies and bodies which don't shrink go as they are
+	for _, body := range []string{"short", "\x8f\x01\xd3\x7a\x10\xee\x42\x99\x05\xc1\x3b\x77"} {
+		if f := (&frame{body: []byte(body)}); cp.pack(f) != f {
+			t.Fatalf("%q compressed", body)
+		}
+	}
+	if err := (compression{}).unpack(&frame{flags: flagCompressed}, 10); err != ErrNoCompressor {
+		t.Fatalf("got %v, want no compressor", err)
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	s := NewServer(WithCompression(64, "flate", "gzip"), WithMaxFrameSize(1<<20))
+	RegisterFunc(s, "Echo", func(ctx context.Context, r nameReq) (nameReq, error) { return nameReq{r.Name + r.Name}, nil })
+	addr := serve(t, s)
+	big := strings.Repeat("abcdefgh", 40000)
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{[]Option{WithCompression(0)}, "flate"},
+		{[]Option{WithCompression(10, "gzip")}, "gzip"},
+		{[]Option{WithCompression(10, "zstd", "gzip")}, "gzip"},
+		{[]Option{WithCompression(10, "zstd")}, ""},
+		{nil, ""},
+		{[]Option{WithCodecs("binary"), WithCompression(0, "flate")}, "flate"},
+	} {
+		c := newTestClient(t, addr, append(tc.opts, WithMaxFrameSize(1<<20), WithPool(PoolConfig{MinConns: 1}))...)
+		for _, n := range []string{"x", big} {
+			var res nameReq
+			if err := c.Call("Echo", nameReq{n}, &res); err != nil || res.Name != n+n {
+				t.Fatal(tc.want, err)
+			}
+		}
+		calls := []*BatchCall{{Name: "Echo", Req: nameReq{big[:5000]}, Res: &nameReq{}}, {Name: "Echo", Req: nameReq{"y"}, Res: &nameReq{}}}
+		if err := c.CallBatch(context.Background(), calls); err != nil || calls[0].Res.(*nameReq).Name != big[:10000] {
+			t.Fatal(tc.want, err)
+		}
+		got := ""
+		if comp := c.endpoints[0].conns[0].compress.c; comp != nil {
+			got = comp.Name()
+		}
+		if got != tc.want {
+			t.Fatalf("connection compresses with %q, want %q", got, tc.want)
+		}
+	}
+	//a server without compression talks to a client which offers it
+	s2 := NewServer()
+	RegisterFunc(s2, "Add", add)
+	var res addRes
+	if err := newTestClient(t, serve(t, s2), WithCompression(0)).Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+//category of a failed call
+type ErrorCode int
+
+const (
+	CodeUnknown         ErrorCode = iota //the server sent no code
+	CodeMethodNotFound                   //no handler is registered by the name
+	CodeBadRequest                       //the request can't be decoded
+	CodeInternal                         //the handler failed
+	CodeUnavailable                      //the server can't take the call now, try again or elsewhere
+	CodeUnauthenticated                  //the client holds no key the server accepts
+	CodeOverloaded                       //the method is over its rate or concurrency limit
+)
+
+var codeText = map[ErrorCode]string{
+	CodeUnknown:         "unknown error",
+	CodeMethodNotFound:  "method not found",
+	CodeBadRequest:      "bad request",
+	CodeInternal:        "internal error",
+	CodeUnavailable:     "unavailable",
+	CodeUnauthenticated: "unauthenticated",
+	CodeOverloaded:      "overloaded",
+}
+
+func (c ErrorCode) String() string {
+	if t, ok := codeText[c]; ok {
+		return t
+	}
+	return fmt.Sprintf("error code %d", int(c))
+}
+
+//errors to compare with errors.Is, only the code is compared
+var (
+	ErrMethodNotFound  = &Error{Code: CodeMethodNotFound}
+	ErrBadRequest      = &Error{Code: CodeBadRequest}
+	ErrInternal        = &Error{Code: CodeInternal}
+	ErrUnavailable     = &Error{Code: CodeUnavailable}
+	ErrUnauthenticated = &Error{Code: CodeUnauthenticated}
+	ErrOverloaded      = &Error{Code: CodeOverloaded}
+)
+
+//error of a call which the server answered with a failure. it travels in
+//the body of a response frame flagged with flagError, always as json so it
+//can be read whatever codec the connection uses.
+type Error struct {
+	Code      ErrorCode         `json:"code"`
+	Message   string            `json:"message"`
+	Retryable bool              `json:"retryable"`         //the same call may succeed later
+	Details   map[string]string `json:"details,omitempty"` //extra facts about the failure
+}
+
+//new error with a formatted message, handlers return it to choose the code
+func Errorf(code ErrorCode, format string, v ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "rpc: " + e.Code.String()
+	}
+	return "rpc: " + e.Code.String() + ": " + e.Message
+}
+
+//errors.Is(err, ErrMethodNotFound) matches any error with the same code
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+//turn any error into the one sent to the caller
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
+
+//body of the error response
+func encodeError(e *Error) []byte {
+	b, err := json.Marshal(e)
+	if err != nil {
+		b, _ = json.Marshal(&Error{Code: e.Code, Message: e.Message})
+	}
+	return b
+}
+
+//parse the body of the error response
+func decodeError(b []byte) *Error {
+	var e Error
+	if err := json.Unmarshal(b, &e); err != nil {
+		return &Error{Code: CodeUnknown, Message: string(b)}
+	}
+	return &e
+}
@@ -0,0 +1,35 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Fail", func(ctx context.Context, r addReq) (addRes, error) {
+		return addRes{}, &Error{Code: CodeInternal, Message: "boom", Retryable: true, Details: map[string]string{"a": "b"}}
+	})
+	RegisterFunc(s, "Add", add)
+	addr := serve(t, s)
+	for _, name := range codecNames {
+		c := newTestClient(t, addr, WithCodecs(name))
+		var res addRes
+		if err := c.Call("Nope", addReq{}, &res); !errors.Is(err, ErrMethodNotFound) {
+			t.Fatalf("%s: got %v, want method not found", name, err)
+		}
+		if err := c.Call("Add", struct{ A []string }{[]string{"x"}}, &res); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("%s: got %v, want bad request", name, err)
+		}
+		err := c.Call("Fail", addReq{}, &res)
+		var e *Error
+		if !errors.As(err, &e) || !e.Retryable || e.Details["a"] != "b" || !errors.Is(err, ErrInternal) {
+			t.Fatalf("%s: got %#v", name, err)
+		}
+		//errors don't break the connection
+		if err := c.Call("Add", addReq{1, 1}, &res); err != nil || res.Sum != 2 {
+			t.Fatal(name, err)
+		}
+	}
+}
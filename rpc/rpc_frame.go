@@ -0,0 +1,171 @@
+package rpc
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+//frame header layout, big endian:
+//magic(2) version(1) kind(1) flags(2) length(4) id(8), then length bytes of body
+const (
+	frameMagic    uint16 = 0x7270 //"rp", never an ascii digit so old packs can be told apart
+	frameVersion  uint8  = 1
+	frameHeadSize int    = 18
+
+	//default max body size of one frame
+	DefaultMaxFrameSize = 4 << 20
+	//how long a peer may take to answer the hello
+	handshakeTimeout = 5 * time.Second
+)
+
+//frame kinds
+const (
+	kindHello        uint8 = iota + 1 //first frame of both sides, negotiates the protocol
+	kindRequest                       //call from client, id is the request id
+	kindResponse                      //result of the request with the same id
+	kindGoAway                        //server is shutting down, send no more requests on the connection
+	kindPing                          //client asks whether the connection is alive
+	kindPong                          //answer of the ping with the same id
+	kindAuth                          //answer of the client to the challenge, then the result from the server
+	kindStreamOpen                    //client opens a stream, body is the request, id is the stream id
+	kindStreamData                    //one message of the stream with the same id, from either side
+	kindStreamEnd                     //sender sends no more messages, the one of the server holds the result
+	kindStreamWindow                  //receiver read messages, body is how many more the sender may send
+	kindBatch                         //many requests in one frame, answered by one response with all the results
+	kindSubscribe                     //client wants the messages of the topic in the body
+	kindUnsubscribe                   //client wants no more messages of the topic in the body
+	kindPush                          //message of the server on a topic, unasked
+)
+
+//frame flags
+const (
+	flagError      uint16 = 1 << iota //response body is an error, not the result
+	flagCompressed                    //body is compressed by the compressor of the connection
+)
+
+var (
+	ErrFrameTooBig  = errors.New("rpc: frame is too big")
+	ErrBadMagic     = errors.New("rpc: bad frame magic")
+	ErrBadHandshake = errors.New("rpc: handshake failed")
+)
+
+//one message of the binary protocol
+type frame struct {
+	version uint8
+	kind    uint8
+	flags   uint16
+	id      uint64
+	body    []byte
+}
+
+//hello body, sent by the client first and answered by the server
+type hello struct {
+	Version      uint8    `json:"version"`               //highest version the sender speaks, the answer holds the one to use
+	MaxFrameSize uint32   `json:"maxFrameSize"`          //biggest body the sender accepts
+	Codecs       []string `json:"codecs,omitempty"`      //codecs the client speaks, preferred first
+	Codec        string   `json:"codec,omitempty"`       //codec the server picked for the connection
+	Nonce        []byte   `json:"nonce,omitempty"`       //challenge of a server which requires a key
+	Compressors  []string `json:"compressors,omitempty"` //compressors the client speaks, preferred first
+	Compressor   string   `json:"compressor,omitempty"`  //compressor the server picked, none when empty
+}
+
+//read one frame, bodies bigger than max are refused
+func readFrame(r io.Reader, max uint32) (*frame, error) {
+	head := make([]byte, frameHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(head[0:2]) != frameMagic {
+		return nil, ErrBadMagic
+	}
+	f := &frame{
+		version: head[2],
+		kind:    head[3],
+		flags:   binary.BigEndian.Uint16(head[4:6]),
+		id:      binary.BigEndian.Uint64(head[10:18]),
+	}
+	l := binary.BigEndian.Uint32(head[6:10])
+	if l > max {
+		return nil, ErrFrameTooBig
+	}
+	f.body = make([]byte, l)
+	if _, err := io.ReadFull(r, f.body); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+//write the frame with a single Write so concurrent writers only need to hold
+//their lock around this call
+func writeFrame(w io.Writer, f *frame) error {
+	b := make([]byte, frameHeadSize+len(f.body))
+	binary.BigEndian.PutUint16(b[0:2], frameMagic)
+	b[2] = f.version
+	if b[2] == 0 {
+		b[2] = frameVersion
+	}
+	b[3] = f.kind
+	binary.BigEndian.PutUint16(b[4:6], f.flags)
+	binary.BigEndian.PutUint32(b[6:10], uint32(len(f.body)))
+	binary.BigEndian.PutUint64(b[10:18], f.id)
+	copy(b[frameHeadSize:], f.body)
+	_, err := w.Write(b)
+	return err
+}
+
+//build the hello frame
+func helloFrame(h hello) (*frame, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return &frame{kind: kindHello, body: b}, nil
+}
+
+//parse the hello frame
+func parseHello(f *frame) (hello, error) {
+	var h hello
+	if f.kind != kindHello {
+		return h, ErrBadHandshake
+	}
+	if err := json.Unmarshal(f.body, &h); err != nil {
+		return h, ErrBadHandshake
+	}
+	if h.Version == 0 || h.MaxFrameSize == 0 {
+		return h, ErrBadHandshake
+	}
+	return h, nil
+}
+
+//request body: varint length and bytes of the name, varint timeout, then the
+//codec encoded args. the args are encoded only once, by the codec
+func encodeRequest(r Request) []byte {
+	e := binEncoder{buf: make([]byte, 0, len(r.ReqName)+len(r.ReqData)+12)}
+	e.uvarint(uint64(len(r.ReqName)))
+	e.buf = append(e.buf, r.ReqName...)
+	e.varint(r.Timeout)
+	e.buf = append(e.buf, r.ReqData...)
+	return e.buf
+}
+
+//parse the request body
+func decodeRequest(body []byte) (Request, error) {
+	var r Request
+	d := binDecoder{buf: body}
+	l, err := d.length()
+	if err != nil {
+		return r, err
+	}
+	name, _ := d.next(l)
+	r.ReqName = string(name)
+	t, n := binary.Varint(d.buf)
+	if n <= 0 {
+		return r, errShortBuffer
+	}
+	r.Timeout = t
+	r.ReqData = d.buf[n:]
+	return r, nil
+}
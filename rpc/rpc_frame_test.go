@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []*frame{
+		{kind: kindRequest, id: 1, body: []byte("hello")},
+		{kind: kindResponse, flags: flagError, id: 1<<63 + 5, body: []byte{0, 1, 2}},
+		{kind: kindPing, id: 7},
+	}
+	for _, f := range frames {
+		if err := writeFrame(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		got, err := readFrame(&buf, 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.version = frameVersion
+		if want.body == nil {
+			want.body = []byte{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFrameRefused(t *testing.T) {
+	var buf bytes.Buffer
+	writeFrame(&buf, &frame{kind: kindRequest, body: make([]byte, 100)})
+	if _, err := readFrame(bytes.NewReader(buf.Bytes()), 99); err != ErrFrameTooBig {
+		t.Fatalf("got %v, want frame too big", err)
+	}
+	b := buf.Bytes()
+	b[0] = '0'
+	if _, err := readFrame(bytes.NewReader(b), 1<<10); err != ErrBadMagic {
+		t.Fatalf("got %v, want bad magic", err)
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	want := Request{ReqName: "GetInfo", ReqData: []byte(`{"username":"bob"}`), Timeout: -42}
+	got, err := decodeRequest(encodeRequest(want))
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if _, err := decodeRequest([]byte{200}); err == nil {
+		t.Fatal("short body accepted")
+	}
+}
+
+func TestHello(t *testing.T) {
+	want := hello{Version: 1, MaxFrameSize: 1 << 20, Codecs: []string{"binary", "json"}, Compressors: []string{"flate"}}
+	f, err := helloFrame(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseHello(f)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+	if _, err := parseHello(&frame{kind: kindHello, body: []byte(`{"version":1}`)}); err != ErrBadHandshake {
+		t.Fatalf("hello without frame size: %v", err)
+	}
+}
+
+type echoReq struct{ S string }
+
+func TestFrameSizeNegotiated(t *testing.T) {
+	s := NewServer()
+	echo := func(r echoReq) echoReq { return r }
+	s.Register("Echo", func(f interface{}) interface{} { return echo(*f.(*echoReq)) }, echo)
+	addr := serve(t, s)
+	big := strings.Repeat("x", 100000)
+	var res echoReq
+	if err := newTestClient(t, addr).Call("Echo", echoReq{big}, &res); err != nil || res.S != big {
+		t.Fatal(err)
+	}
+	//the response is bigger than the client accepts
+	if err := newTestClient(t, addr, WithMaxFrameSize(1000)).Call("Echo", echoReq{big}, &res); err == nil {
+		t.Fatal("response over the frame size accepted")
+	}
+}
+
+func TestLegacyClient(t *testing.T) {
+	s := NewServer()
+	echo := func(r echoReq) echoReq { return r }
+	s.Register("Echo", func(f interface{}) interface{} { return echo(*f.(*echoReq)) }, echo)
+	conn, err := net.Dial("tcp", serve(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d, _ := json.Marshal(echoReq{"hi"})
+	p, _ := toJsons(Request{ReqName: "Echo", ReqData: d})
+	//old clients send ascii length packs, one call after the other
+	for i := 0; i < 3; i++ {
+		conn.Write(p)
+		b, err := readPack(conn)
+		if err != nil || string(b) != `{"S":"hi"}` {
+			t.Fatalf("got %q, %v", b, err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+//register a typed handler. the request is decoded into Req before fn runs,
+//so no type assertion is needed, and an error of fn is sent back to the
+//caller instead of the response.
+func RegisterFunc[Req, Res any](s *Server, name string, fn func(context.Context, Req) (Res, error)) {
+	s.Se[name] = Handler{
+		intfc: func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fn(ctx, *req.(*Req))
+		},
+		reqType: reflect.TypeOf((*Req)(nil)).Elem(),
+		resType: reflect.TypeOf((*Res)(nil)).Elem(),
+	}
+}
+
+//typed call of a handler registered by RegisterFunc
+func Invoke[Req, Res any](ctx context.Context, c *Client, name string, req Req) (Res, error) {
+	var res Res
+	err := c.CallContext(ctx, name, req, &res)
+	return res, err
+}
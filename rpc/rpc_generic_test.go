@@ -0,0 +1,32 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInvoke(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Div", func(ctx context.Context, r addReq) (addRes, error) {
+		if r.B == 0 {
+			return addRes{}, errors.New("divide by zero")
+		}
+		return addRes{r.A / r.B}, nil
+	})
+	addr := serve(t, s)
+	ctx := context.Background()
+	for _, name := range codecNames {
+		c := newTestClient(t, addr, WithCodecs(name))
+		res, err := Invoke[addReq, addRes](ctx, c, "Div", addReq{6, 3})
+		if err != nil || res.Sum != 2 {
+			t.Fatal(name, err, res)
+		}
+		//the error of the handler comes back as the message
+		_, err = Invoke[addReq, addRes](ctx, c, "Div", addReq{6, 0})
+		var e *Error
+		if !errors.As(err, &e) || e.Message != "divide by zero" {
+			t.Fatal(name, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+//ping the connections every heartbeat interval until the client is closed
+func (c *Client) health() {
+	t := time.NewTicker(c.opts.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+			for _, ep := range c.getEndpoints() {
+				ep.checkConns()
+			}
+		}
+	}
+}
+
+//ping every connection at once, dead ones are dropped and the pool is
+//filled up to MinConns again
+func (ep *endpoint) checkConns() {
+	ep.mu.Lock()
+	conns := append([]*clientConn(nil), ep.conns...)
+	ep.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, cc := range conns {
+		if cc.broken() {
+			continue
+		}
+		wg.Add(1)
+		go func(cc *clientConn) {
+			defer wg.Done()
+			if err := cc.ping(ep.opts.heartbeatTimeout); err != nil {
+				log.ErrorLog("rpc_client: ping %s failed, drop the connection. err:%s", ep.addr, err)
+				//the reader sees the close and fails the waiting calls
+				cc.conn.Close()
+				ep.report(&ConnError{Err: err})
+			}
+		}(cc)
+	}
+	wg.Wait()
+	ep.mu.Lock()
+	ep.dropBroken()
+	ep.mu.Unlock()
+	ep.fill()
+}
+
+//send a ping and wait for the pong
+func (cc *clientConn) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := cc.roundTrip(ctx, kindPing, nil)
+	return err
+}
+
+//remember that the connection was used now
+func (sc *serverConn) touch() {
+	atomic.StoreInt64(&sc.last, time.Now().UnixNano())
+}
+
+//a request of the connection finished
+func (sc *serverConn) done() {
+	sc.touch()
+	atomic.AddInt32(&sc.busy, -1)
+}
+
+//close the connection once it is idle for d, until ctx is done
+func (sc *serverConn) watchIdle(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&sc.last)))
+		if idle >= d && atomic.LoadInt32(&sc.busy) == 0 {
+			log.InfoLog("rpc_server: close idle connection %s", sc.conn.RemoteAddr())
+			sc.conn.Close()
+			return
+		}
+		wait := d - idle
+		if wait <= 0 {
+			wait = d
+		}
+		t.Reset(wait)
+	}
+}
@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s := NewServer(WithIdleTimeout(150 * time.Millisecond))
+	RegisterFunc(s, "Add", add)
+	addr := serve(t, s)
+	quiet := newTestClient(t, addr, WithPool(PoolConfig{MinConns: 1}))
+	live := newTestClient(t, addr, WithHeartbeat(40*time.Millisecond, 40*time.Millisecond), WithPool(PoolConfig{MinConns: 2}))
+	time.Sleep(400 * time.Millisecond)
+	if st := quiet.Stats(); st.Open != 0 {
+		t.Fatalf("%d silent connections left open by the idle timeout", st.Open)
+	}
+	if st := live.Stats(); st.Open != 2 {
+		t.Fatalf("%d pinged connections open, want 2", st.Open)
+	}
+}
+
+func TestHeartbeatRedial(t *testing.T) {
+	s := NewServer()
+	l, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	addr := l.Addr().String()
+	c := newTestClient(t, addr, WithHeartbeat(40*time.Millisecond, 40*time.Millisecond), WithPool(PoolConfig{MinConns: 2}))
+	time.Sleep(50 * time.Millisecond)
+	//kill every connection, the pings find out and dial the new server
+	s.Shutdown(context.Background())
+	s2 := NewServer()
+	RegisterFunc(s2, "Add", add)
+	l2, err := s2.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s2.Serve(l2)
+	defer s2.Shutdown(context.Background())
+	time.Sleep(200 * time.Millisecond)
+	if st := c.Stats(); st.Open != 2 {
+		t.Fatalf("%d connections open after the restart, want 2", st.Open)
+	}
+	var res addRes
+	if err := c.Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+)
+
+//what an interceptor knows about the call
+type CallInfo struct {
+	Method  string       //registered name of the handler
+	ReqType reflect.Type //request struct type
+	ResType reflect.Type //response struct type
+	Stream  bool         //req opens a stream, see RegisterStream
+}
+
+//next step of the chain, the last one runs the registered handler.
+//req is a pointer to the decoded request struct.
+type HandlerFunc func(ctx context.Context, req interface{}) (interface{}, error)
+
+//server interceptor, wraps every registered handler. it may change ctx or
+//req, answer without calling next, or look at what next returns.
+type Interceptor func(ctx context.Context, info *CallInfo, req interface{}, next HandlerFunc) (interface{}, error)
+
+//add interceptors to the server, the first one added runs outermost.
+//call Use before Serve.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+}
+
+//run the handler through the interceptors
+func (s *Server) invoke(ctx context.Context, h Handler, name string, req interface{}) (interface{}, error) {
+	if len(s.interceptors) == 0 {
+		return h.intfc(ctx, req)
+	}
+	info := &CallInfo{Method: name, ReqType: h.reqType, ResType: h.resType, Stream: h.stream}
+	return chain(s.interceptors, info, h.intfc)(ctx, req)
+}
+
+//build the chain from the inside out
+func chain(interceptors []Interceptor, info *CallInfo, last HandlerFunc) HandlerFunc {
+	next := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, n := interceptors[i], next
+		next = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return ic(ctx, info, req, n)
+		}
+	}
+	return next
+}
+
+//next step of the client chain, the last one sends the call
+type Invoker func(ctx context.Context, method string, req interface{}, res interface{}) error
+
+//client interceptor, wraps every call of the client including its retries
+type ClientInterceptor func(ctx context.Context, method string, req interface{}, res interface{}, invoker Invoker) error
+
+//build the client chain from the inside out, the first interceptor runs outermost
+func chainClient(interceptors []ClientInterceptor, last Invoker) Invoker {
+	next := last
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		ic, n := interceptors[i], next
+		next = func(ctx context.Context, method string, req interface{}, res interface{}) error {
+			return ic(ctx, method, req, res, n)
+		}
+	}
+	return next
+}
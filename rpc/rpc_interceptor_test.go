@@ -0,0 +1,38 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestInterceptors(t *testing.T) {
+	s := NewServer()
+	var order []string
+	mark := func(name string) Interceptor {
+		return func(ctx context.Context, info *CallInfo, req interface{}, next HandlerFunc) (interface{}, error) {
+			order = append(order, name+" "+info.Method)
+			//a request with A 99 is answered without the handler
+			if r := req.(*addReq); r.A == 99 {
+				return addRes{Sum: -1}, nil
+			}
+			return next(ctx, req)
+		}
+	}
+	s.Use(mark("a"), mark("b"))
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s))
+	var res addRes
+	if err := c.Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err, res)
+	}
+	if want := []string{"a Add", "b Add"}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("ran %v, want %v", order, want)
+	}
+	if err := c.Call("Add", addReq{99, 2}, &res); err != nil || res.Sum != -1 {
+		t.Fatal(err, res)
+	}
+	if len(order) != 3 {
+		t.Fatalf("ran %v, b must be skipped", order)
+	}
+}
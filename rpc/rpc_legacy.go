@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+//header size of the old ascii length packs
+const TcpHeadMaxSize int = 4
+
+//serve a client which speaks the old format: TcpHeadMaxSize ascii digits of
+//length and a json Request, answered with the json of the response the same
+//way. such clients wait for each response, so requests are handled in order.
+func (s *Server) handleLegacy(ctx context.Context, sc *serverConn) error {
+	for {
+		b, err := readPack(sc.r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sc.touch()
+		var req Request
+		if err = json.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		//such clients can't be told about errors or shutdown, drop the connection
+		if !s.begin() {
+			return ErrServerClosed
+		}
+		atomic.AddInt32(&sc.busy, 1)
+		err = s.serveLegacy(ctx, sc, req)
+		sc.done()
+		s.end()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//handle one request of the old format
+func (s *Server) serveLegacy(ctx context.Context, sc *serverConn, req Request) error {
+	resp, err := s.find(ctx, JSONCodec{}, req)
+	if err != nil {
+		return err
+	}
+	respJ, err := s.ToJson(resp)
+	if err != nil {
+		return err
+	}
+	_, err = sc.conn.Write(respJ)
+	return err
+}
+
+func (s *Server) ToJson(f interface{}) ([]byte, error) {
+	return toJsons(f)
+}
+
+//pack the interface to json format and return
+func toJsons(f interface{}) ([]byte, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	l := len(b)
+	//convert int to string
+	lStr := strconv.Itoa(l)
+
+	iL := len(lStr)
+	//l := len(strconv.Itoa(len(b)))
+	//l size,compare with teh TcpHeadMaxSize
+	if iL > TcpHeadMaxSize {
+		return nil, errors.New("rpc_server: header is too big")
+	}
+	iL = iL - 1
+	tb := []byte("0")
+	j := make([]byte, TcpHeadMaxSize+l)
+	//request head
+	for i := TcpHeadMaxSize - 1; i >= 0; i-- {
+		if iL < 0 {
+			j[i] = tb[0]
+		} else {
+			j[i] = []byte(lStr)[iL]
+			iL = iL - 1
+		}
+	}
+	//request body
+	for i := 0; i < l; i++ {
+		j[TcpHeadMaxSize+i] = b[i]
+	}
+	return j, nil
+}
+
+//read one pack: TcpHeadMaxSize bytes of length, then the body
+func readPack(r io.Reader) ([]byte, error) {
+	dLen := make([]byte, TcpHeadMaxSize)
+	if _, err := io.ReadFull(r, dLen); err != nil {
+		return nil, err
+	}
+	l, err := strconv.ParseInt(string(dLen), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	//get the data of l length pack
+	b := make([]byte, l)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
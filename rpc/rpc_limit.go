@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//key of WithLimits for the methods without a limit of their own
+const AllMethods = "*"
+
+//which limit refused a call, in the "limit" detail of CodeOverloaded errors
+const (
+	LimitRate        = "rate"
+	LimitConcurrency = "concurrency"
+)
+
+//limit of one method of the server. calls over it are refused at once
+//with CodeOverloaded instead of queueing up behind the database.
+type Limit struct {
+	Rate          float64 //calls per second, 0 means no rate limit
+	Burst         int     //calls allowed at once above the rate, at least 1, Rate when 0
+	MaxConcurrent int     //calls running at once, 0 means no limit
+}
+
+//set the limits of the methods by name, AllMethods holds the limit of the
+//others. every method gets its own token bucket and counter.
+func WithLimits(limits map[string]Limit) Option {
+	return func(o *options) {
+		o.limits = limits
+	}
+}
+
+//parse "rate,burst,concurrent" like "200,400,100", missing fields are 0
+func ParseLimit(s string) (Limit, error) {
+	var l Limit
+	parts := strings.Split(s, ",")
+	if len(parts) > 3 {
+		return l, fmt.Errorf("rpc_server: bad limit %q, want rate,burst,concurrent", s)
+	}
+	var err error
+	for i, p := range parts {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		switch i {
+		case 0:
+			l.Rate, err = strconv.ParseFloat(p, 64)
+		case 1:
+			l.Burst, err = strconv.Atoi(p)
+		case 2:
+			l.MaxConcurrent, err = strconv.Atoi(p)
+		}
+		if err != nil {
+			return l, fmt.Errorf("rpc_server: bad limit %q: %v", s, err)
+		}
+	}
+	if l.Rate < 0 || l.Burst < 0 || l.MaxConcurrent < 0 {
+		return l, fmt.Errorf("rpc_server: bad limit %q, negative value", s)
+	}
+	return l, nil
+}
+
+//token bucket and running calls of one method
+type limiter struct {
+	limit Limit
+	burst float64
+
+	mu     sync.Mutex //protect the fields below
+	tokens float64
+	last   time.Time //when tokens was filled up last
+	active int
+}
+
+func newLimiter(l Limit) *limiter {
+	burst := float64(l.Burst)
+	if burst == 0 {
+		burst = l.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{limit: l, burst: burst, tokens: burst, last: time.Now()}
+}
+
+//take a token and a slot for a call of name, release must follow when it is nil
+func (l *limiter) acquire(name string) *Error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.MaxConcurrent > 0 && l.active >= l.limit.MaxConcurrent {
+		return overloaded(name, LimitConcurrency, "%d calls running", l.active)
+	}
+	if l.limit.Rate > 0 {
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.limit.Rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens < 1 {
+			return overloaded(name, LimitRate, "over %g calls per second", l.limit.Rate)
+		}
+		l.tokens--
+	}
+	l.active++
+	return nil
+}
+
+//the call taken by acquire finished
+func (l *limiter) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+}
+
+func overloaded(name string, limit string, format string, v ...interface{}) *Error {
+	e := Errorf(CodeOverloaded, "rpc_server:%s refused, "+format, append([]interface{}{name}, v...)...)
+	e.Details = map[string]string{"limit": limit}
+	return e
+}
+
+//limiter of the method name, nil when it has no limit
+func (s *Server) limiter(name string) *limiter {
+	if len(s.opts.limits) == 0 || name == MethodsName {
+		return nil
+	}
+	s.lMu.Lock()
+	defer s.lMu.Unlock()
+	if l, ok := s.limiters[name]; ok {
+		return l
+	}
+	lim, ok := s.opts.limits[name]
+	if !ok {
+		lim, ok = s.opts.limits[AllMethods]
+	}
+	var l *limiter
+	if ok && (lim.Rate > 0 || lim.MaxConcurrent > 0) {
+		l = newLimiter(lim)
+	}
+	//methods without a limit are remembered as nil
+	if s.limiters == nil {
+		s.limiters = make(map[string]*limiter)
+	}
+	s.limiters[name] = l
+	return l
+}
@@ -0,0 +1,84 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	if l, err := ParseLimit("200, 400,100"); err != nil || l != (Limit{200, 400, 100}) {
+		t.Fatal(l, err)
+	}
+	if l, err := ParseLimit("0,,5"); err != nil || l != (Limit{MaxConcurrent: 5}) {
+		t.Fatal(l, err)
+	}
+	for _, s := range []string{"x", "1,2,3,4", "-1"} {
+		if _, err := ParseLimit(s); err == nil {
+			t.Fatalf("%q accepted", s)
+		}
+	}
+}
+
+func TestLimitRate(t *testing.T) {
+	s := NewServer(WithLimits(map[string]Limit{"Add": {Rate: 10, Burst: 3}}))
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s))
+	for i := 0; i < 3; i++ {
+		if err := c.Call("Add", addReq{}, &addRes{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := c.Call("Add", addReq{}, &addRes{})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeOverloaded || e.Details["limit"] != LimitRate {
+		t.Fatalf("got %v, want the rate limit", err)
+	}
+	//a token every 100ms
+	time.Sleep(110 * time.Millisecond)
+	if err := c.Call("Add", addReq{}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	//the listing of methods is never limited
+	if _, err := c.Methods(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	s := NewServer(WithLimits(map[string]Limit{AllMethods: {MaxConcurrent: 2}}))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	RegisterFunc(s, "Wait", func(ctx context.Context, r addReq) (addRes, error) {
+		started <- struct{}{}
+		<-release
+		return addRes{}, nil
+	})
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s))
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- c.Call("Wait", addReq{}, &addRes{}) }()
+		<-started
+	}
+	err := c.Call("Wait", addReq{}, &addRes{})
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeOverloaded || e.Details["limit"] != LimitConcurrency {
+		t.Fatalf("got %v, want the concurrency limit", err)
+	}
+	//every method has its own counter
+	if err := c.Call("Add", addReq{}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() { <-started }()
+	if err := c.Call("Wait", addReq{}, &addRes{}); err != nil {
+		t.Fatal("slot not released:", err)
+	}
+}
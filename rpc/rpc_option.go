@@ -0,0 +1,95 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+//settings shared by Server and Client
+type options struct {
+	maxFrameSize uint32      //biggest frame body this side accepts
+	codecs       []string    //client: codecs to offer, preferred first. server: codecs to accept, empty means all
+	tls          *tls.Config //nil means plain tcp
+	auth         *Keyring    //nil means no challenge
+	transport    Transport   //how connections are made
+
+	interceptors     []ClientInterceptor //client only
+	retry            RetryPolicy         //client only
+	pool             PoolConfig          //client only
+	balancer         Balancer            //client only
+	eject            EjectPolicy         //client only
+	resolveInterval  time.Duration       //client only
+	breaker          *BreakerPolicy      //client only, nil means no breakers
+	heartbeat        time.Duration       //client only: interval of the pings, 0 means no pings
+	heartbeatTimeout time.Duration       //client only: wait for the pong before the connection is dropped
+	idleTimeout      time.Duration       //server only: close connections silent for this long, 0 means never
+	limits           map[string]Limit    //server only: limits of the methods by name
+	batchWorkers     int                 //server only: batch items run at once
+
+	compressors       []string //client: compressors to offer, preferred first. server: compressors to accept
+	compressThreshold int      //bodies from this size on are compressed, 0 means no compression
+}
+
+//option of NewServer and NewClient
+type Option func(*options)
+
+//set the biggest frame body this side accepts, the peer learns it in the handshake
+func WithMaxFrameSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxFrameSize = uint32(n)
+		}
+	}
+}
+
+//set the codecs by name. a client offers them in this order, a server
+//accepts only these
+func WithCodecs(names ...string) Option {
+	return func(o *options) {
+		o.codecs = names
+	}
+}
+
+//add client interceptors, the first one runs outermost
+func WithClientInterceptors(interceptors ...ClientInterceptor) Option {
+	return func(o *options) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+//set the retry policy of the client, by default nothing is retried
+func WithRetry(p RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = p
+	}
+}
+
+//ping every connection of the client each interval, connections which don't
+//answer within timeout are dropped and dialed again
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = interval
+		o.heartbeatTimeout = timeout
+		if timeout <= 0 {
+			o.heartbeatTimeout = interval
+		}
+	}
+}
+
+//close server connections which send nothing for d while no request of
+//them is running. pings of the client count, so d should be longer than
+//the heartbeat interval of the clients
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = d
+	}
+}
+
+//apply opts on the defaults
+func newOptions(opts []Option) options {
+	o := options{maxFrameSize: DefaultMaxFrameSize, transport: TCP(), batchWorkers: defaultBatchWorkers}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
@@ -0,0 +1,417 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+var ErrPoolTimeout = errors.New("rpc_client: no connection free in time")
+
+//size of the connection pool of each endpoint. connections are dialed when
+//the calls need them and closed again when they stay idle.
+type PoolConfig struct {
+	MinConns    int           //connections kept open even when idle
+	MaxConns    int           //upper bound of open connections, NewClient's n when 0
+	MaxStreams  int           //calls in flight on one connection before another is dialed
+	IdleTimeout time.Duration //close connections beyond MinConns unused for this long, 0 means never
+	WaitTimeout time.Duration //wait for a free connection when all are busy, 0 means until ctx is done
+}
+
+//numbers of the pool at one moment
+type PoolStats struct {
+	Open         int    //connections open
+	InUse        int    //connections with calls in flight
+	Idle         int    //connections without calls
+	InFlight     int    //calls holding a connection
+	Waits        uint64 //calls which waited for a free connection
+	WaitTimeouts uint64 //calls which gave up waiting
+	Dials        uint64 //connections dialed
+	DialFailures uint64 //dials which failed
+}
+
+//set the pool of every endpoint of the client
+func WithPool(p PoolConfig) Option {
+	return func(o *options) {
+		o.pool = p
+	}
+}
+
+//fill the zero fields of the pool config, n is the size given to NewClient
+func (p PoolConfig) normalize(n int) PoolConfig {
+	if p.MaxConns <= 0 {
+		p.MaxConns = n
+	}
+	if p.MaxConns <= 0 {
+		p.MaxConns = 1
+	}
+	if p.MinConns < 0 {
+		p.MinConns = 0
+	}
+	if p.MinConns > p.MaxConns {
+		p.MinConns = p.MaxConns
+	}
+	if p.MaxStreams <= 0 {
+		p.MaxStreams = defaultMaxStreams
+	}
+	return p
+}
+
+//calls in flight on one connection before another is dialed by default
+const defaultMaxStreams = 64
+
+//idle connections are looked for at most this often
+const minShrinkInterval = 10 * time.Millisecond
+
+//one server of the client with its own connection pool
+type endpoint struct {
+	addr string
+	host string //host name of the address, verified by TLS
+	opts *options
+
+	mu          sync.Mutex //protect the fields below
+	conns       []*clientConn
+	dialing     int           //connections being dialed, they count against MaxConns
+	wake        chan struct{} //closed when a connection may be free, then replaced
+	closed      bool
+	retired     bool                //the resolver dropped it, close when the calls finish
+	outstanding int                 //calls holding a connection
+	failures    int                 //connection failures in a row
+	ejectedTill time.Time           //the balancer skips the endpoint until then
+	breakers    map[string]*breaker //circuit breakers by method
+	push        *clientConn         //connection for the subscriptions, out of the pool
+
+	waits, waitTimeouts, dials, dialFailures uint64 //counters of PoolStats
+}
+
+func newEndpoint(addr string, host string, o *options) *endpoint {
+	return &endpoint{addr: addr, host: host, opts: o, wake: make(chan struct{})}
+}
+
+//address of the server
+func (ep *endpoint) Addr() string {
+	return ep.addr
+}
+
+//calls in flight on the endpoint
+func (ep *endpoint) Outstanding() int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.outstanding
+}
+
+//open a new connection to the server. the dial and the handshakes end
+//with ctx or after handshakeTimeout, whichever comes first.
+func (ep *endpoint) dial(ctx context.Context) (*clientConn, error) {
+	dctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	cc, err := ep.connect(dctx)
+	if err == nil {
+		return cc, nil
+	}
+	//the caller gave up, the server may be fine. the deadline of the
+	//connection may pass before the one of ctx fires.
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return nil, context.DeadlineExceeded
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return nil, err
+}
+
+//dial the server, run the TLS handshake and say hello within ctx
+func (ep *endpoint) connect(ctx context.Context) (*clientConn, error) {
+	connect, err := ep.opts.transport.Dial(ctx, ep.addr)
+	if err != nil {
+		return nil, err
+	}
+	if ep.opts.tls != nil {
+		tc, err := clientTLS(ctx, connect, ep.opts.tls, ep.host)
+		if err != nil {
+			connect.Close()
+			return nil, err
+		}
+		connect = tc
+	}
+	cc, err := newClientConn(ctx, connect, *ep.opts)
+	if err != nil {
+		connect.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+//take a connection for one call, the least busy one. a new connection is
+//dialed when all are full and the pool may grow, otherwise the call waits.
+//the connection must be given back with release.
+func (ep *endpoint) getConn(ctx context.Context) (*clientConn, error) {
+	pool := &ep.opts.pool
+	var timeout <-chan time.Time
+	waited := false
+	ep.mu.Lock()
+	for {
+		if ep.closed {
+			ep.mu.Unlock()
+			if ep.retired {
+				//another server may take the call
+				return nil, &ConnError{Err: errRetired}
+			}
+			return nil, ErrClientClosed
+		}
+		ep.dropBroken()
+		var best *clientConn
+		for _, cc := range ep.conns {
+			if best == nil || cc.inFlight < best.inFlight {
+				best = cc
+			}
+		}
+		if best != nil && best.inFlight < pool.MaxStreams {
+			ep.take(best)
+			ep.mu.Unlock()
+			return best, nil
+		}
+		if len(ep.conns)+ep.dialing < pool.MaxConns {
+			cc, err := ep.grow(ctx)
+			if err != nil {
+				ep.mu.Unlock()
+				if err == context.DeadlineExceeded || err == context.Canceled {
+					return nil, err
+				}
+				//the server refused us in the handshake, another attempt won't help
+				if e, ok := err.(*Error); ok {
+					return nil, e
+				}
+				return nil, &ConnError{Err: err}
+			}
+			ep.take(cc)
+			ep.mu.Unlock()
+			return cc, nil
+		}
+		//the pool is full, wait for a call to finish
+		if !waited {
+			waited = true
+			ep.waits++
+			if pool.WaitTimeout > 0 {
+				t := time.NewTimer(pool.WaitTimeout)
+				defer t.Stop()
+				timeout = t.C
+			}
+		}
+		wake := ep.wake
+		ep.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			ep.mu.Lock()
+			ep.waitTimeouts++
+			ep.mu.Unlock()
+			return nil, ErrPoolTimeout
+		}
+		ep.mu.Lock()
+	}
+}
+
+//count a call on the connection, called with ep.mu held
+func (ep *endpoint) take(cc *clientConn) {
+	cc.inFlight++
+	ep.outstanding++
+}
+
+//give back the connection taken by getConn
+func (ep *endpoint) release(cc *clientConn) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	cc.inFlight--
+	cc.lastUsed = time.Now()
+	ep.outstanding--
+	ep.broadcast()
+	if ep.retired && ep.outstanding == 0 {
+		ep.closeLocked()
+	}
+}
+
+//dial a connection and add it to the pool, called and returns with ep.mu held.
+//the lock is released during the dial so other calls go on.
+func (ep *endpoint) grow(ctx context.Context) (*clientConn, error) {
+	ep.dialing++
+	ep.mu.Unlock()
+	cc, err := ep.dial(ctx)
+	ep.mu.Lock()
+	ep.dialing--
+	ep.dials++
+	if err != nil {
+		if err != context.DeadlineExceeded && err != context.Canceled {
+			ep.dialFailures++
+		}
+		//waiters may dial themselves now
+		ep.broadcast()
+		return nil, err
+	}
+	if ep.closed {
+		cc.conn.Close()
+		return nil, ErrClientClosed
+	}
+	cc.lastUsed = time.Now()
+	ep.conns = append(ep.conns, cc)
+	//calls waiting while the pool was full may share the new connection
+	ep.broadcast()
+	return cc, nil
+}
+
+//open connections until MinConns, failures are left for the next time
+func (ep *endpoint) fill() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for !ep.closed && len(ep.conns)+ep.dialing < ep.opts.pool.MinConns {
+		if _, err := ep.grow(context.Background()); err != nil {
+			log.ErrorLog("rpc_client: dial %s failed. err:%s", ep.addr, err)
+			ep.fail()
+			return
+		}
+	}
+}
+
+//remove broken and going away connections from the pool, called with ep.mu held.
+//their calls in flight still finish.
+func (ep *endpoint) dropBroken() {
+	conns := ep.conns[:0]
+	for _, cc := range ep.conns {
+		if !cc.broken() {
+			conns = append(conns, cc)
+		}
+	}
+	for i := len(conns); i < len(ep.conns); i++ {
+		ep.conns[i] = nil
+	}
+	ep.conns = conns
+}
+
+//wake every call waiting for a connection, called with ep.mu held
+func (ep *endpoint) broadcast() {
+	close(ep.wake)
+	ep.wake = make(chan struct{})
+}
+
+//close connections beyond MinConns idle longer than IdleTimeout
+func (ep *endpoint) shrink() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	pool := &ep.opts.pool
+	ep.dropBroken()
+	open := len(ep.conns)
+	conns := ep.conns[:0]
+	for _, cc := range ep.conns {
+		if open > pool.MinConns && cc.inFlight == 0 && time.Since(cc.lastUsed) > pool.IdleTimeout {
+			cc.conn.Close()
+			open--
+			continue
+		}
+		conns = append(conns, cc)
+	}
+	for i := len(conns); i < len(ep.conns); i++ {
+		ep.conns[i] = nil
+	}
+	ep.conns = conns
+}
+
+//close every connection, calls waiting for one fail
+func (ep *endpoint) close() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.closeLocked()
+}
+
+//close the endpoint once its calls in flight finish
+func (ep *endpoint) retire() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.retired = true
+	if ep.outstanding == 0 {
+		ep.closeLocked()
+	}
+}
+
+//close called with ep.mu held
+func (ep *endpoint) closeLocked() {
+	if ep.closed {
+		return
+	}
+	ep.closed = true
+	ep.broadcast()
+	for _, cc := range ep.conns {
+		cc.conn.Close()
+	}
+	if ep.push != nil {
+		ep.push.conn.Close()
+	}
+}
+
+//numbers of the pool now
+func (ep *endpoint) stats() PoolStats {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.dropBroken()
+	st := PoolStats{
+		Open:         len(ep.conns),
+		Waits:        ep.waits,
+		WaitTimeouts: ep.waitTimeouts,
+		Dials:        ep.dials,
+		DialFailures: ep.dialFailures,
+	}
+	for _, cc := range ep.conns {
+		st.InFlight += cc.inFlight
+		if cc.inFlight > 0 {
+			st.InUse++
+		} else {
+			st.Idle++
+		}
+	}
+	return st
+}
+
+//add the numbers of o
+func (st *PoolStats) add(o PoolStats) {
+	st.Open += o.Open
+	st.InUse += o.InUse
+	st.Idle += o.Idle
+	st.InFlight += o.InFlight
+	st.Waits += o.Waits
+	st.WaitTimeouts += o.WaitTimeouts
+	st.Dials += o.Dials
+	st.DialFailures += o.DialFailures
+}
+
+//close idle connections of every endpoint until the client is closed
+func (c *Client) shrink() {
+	interval := c.opts.pool.IdleTimeout / 2
+	if interval < minShrinkInterval {
+		interval = minShrinkInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		for _, ep := range c.getEndpoints() {
+			ep.shrink()
+		}
+	}
+}
+
+//numbers of the pools of all endpoints added up
+func (c *Client) Stats() PoolStats {
+	var st PoolStats
+	for _, ep := range c.getEndpoints() {
+		st.add(ep.stats())
+	}
+	return st
+}
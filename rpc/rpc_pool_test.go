@@ -0,0 +1,115 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	s := slowServer()
+	c, err := NewClient(3, serve(t, s), WithPool(PoolConfig{MaxStreams: 2, IdleTimeout: 100 * time.Millisecond, WaitTimeout: 30 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	//connections are dialed lazily
+	if st := c.Stats(); st.Open != 0 {
+		t.Fatal(st)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.Call("Slow", addReq{A: 150}, &addRes{})
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st := c.Stats(); st.Open != 3 || st.InFlight != 6 || st.InUse != 3 {
+		t.Fatalf("%+v, want 3 connections with 6 calls", st)
+	}
+	//all 3 connections carry 2 calls, the next call waits and gives up
+	if err := c.Call("Slow", addReq{A: 1}, &addRes{}); !errors.Is(err, ErrPoolTimeout) {
+		t.Fatalf("got %v, want pool timeout", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := c.Stats(); st.Waits < 1 || st.WaitTimeouts != 1 || st.Dials != 3 || st.Idle != 3 {
+		t.Fatal(st)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if st := c.Stats(); st.Open != 0 {
+		t.Fatalf("%d idle connections not closed", st.Open)
+	}
+}
+
+func TestPoolTinyIdleTimeout(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s), WithPool(PoolConfig{IdleTimeout: time.Nanosecond}))
+	if err := c.Call("Add", addReq{1, 2}, &addRes{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoolDialFailure(t *testing.T) {
+	c := newTestClient(t, "127.0.0.1:1", WithPool(PoolConfig{MinConns: 1}))
+	if err := c.Call("Add", addReq{}, &addRes{}); err == nil {
+		t.Fatal("call without a server succeeded")
+	}
+	if st := c.Stats(); st.DialFailures == 0 {
+		t.Fatal(st)
+	}
+}
+
+//a server which accepts connections and never says hello
+func silentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestPoolDialContext(t *testing.T) {
+	c := newTestClient(t, silentServer(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.CallContext(ctx, "Add", addReq{}, &addRes{}); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want deadline exceeded", err)
+	}
+	//canceled without a deadline
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := c.CallContext(ctx, "Add", addReq{}, &addRes{}); err != context.Canceled {
+		t.Fatalf("got %v, want canceled", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("the handshakes took %s", took)
+	}
+	//the server did nothing wrong
+	if st := c.Stats(); st.DialFailures != 0 {
+		t.Fatalf("%d dial failures counted", st.DialFailures)
+	}
+}
@@ -0,0 +1,389 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+//how often the client checks its subscription connections when there are no heartbeats
+const defaultPushInterval = 5 * time.Second
+
+//messages a subscription holds for a slow handler, more are dropped.
+//a server holds as many for a subscribed connection, it closes the
+//connections which fall further behind.
+const pushQueue = 64
+
+//time a push frame may take to write before the connection is closed
+const pushWriteTimeout = 5 * time.Second
+
+//message a server published on a topic
+type Message struct {
+	Topic string
+	Data  []byte //the message in the codec of the connection
+	codec Codec
+}
+
+//decode the message into v
+func (m *Message) Decode(v interface{}) error {
+	return m.codec.Unmarshal(m.Data, v)
+}
+
+//body of a push frame: the topic with its length, then the message
+func encodePush(topic string, data []byte) []byte {
+	e := binEncoder{buf: make([]byte, 0, len(topic)+len(data)+4)}
+	e.uvarint(uint64(len(topic)))
+	e.buf = append(e.buf, topic...)
+	e.buf = append(e.buf, data...)
+	return e.buf
+}
+
+//parse the body of a push frame
+func decodePush(body []byte) (string, []byte, error) {
+	d := binDecoder{buf: body}
+	l, err := d.length()
+	if err != nil {
+		return "", nil, err
+	}
+	topic, _ := d.next(l)
+	return string(topic), d.buf, nil
+}
+
+//queue msg for the clients subscribed to topic and return how many
+//connections it went to. it never waits for the clients: a connection
+//whose queue is full is closed, its client dials again and subscribes anew.
+//it is for small, rare messages like "this user changed".
+func (s *Server) Publish(topic string, msg interface{}) (int, error) {
+	s.mu.Lock()
+	conns := make([]*serverConn, 0, len(s.subs[topic]))
+	for sc := range s.subs[topic] {
+		conns = append(conns, sc)
+	}
+	s.mu.Unlock()
+	//encode once for every codec in use
+	bodies := make(map[string][]byte)
+	for _, sc := range conns {
+		name := sc.codec.Name()
+		if _, ok := bodies[name]; ok {
+			continue
+		}
+		data, err := sc.codec.Marshal(msg)
+		if err != nil {
+			return 0, err
+		}
+		bodies[name] = encodePush(topic, data)
+	}
+	var firstErr error
+	sent := 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sc := range conns {
+		body := bodies[sc.codec.Name()]
+		if uint32(len(body)) > sc.peerMaxFrame {
+			if firstErr == nil {
+				firstErr = ErrFrameTooBig
+			}
+			continue
+		}
+		if sc.pushes == nil {
+			//unsubscribed meanwhile
+			continue
+		}
+		select {
+		case sc.pushes <- body:
+			sent++
+		default:
+			log.ErrorLog("rpc_server: subscriber %s is %d messages behind, close it", sc.conn.RemoteAddr(), pushQueue)
+			close(sc.pushes)
+			sc.pushes = nil
+			//closing a tls connection writes too
+			go sc.conn.Close()
+		}
+	}
+	return sent, firstErr
+}
+
+//write the push frames of q until it is closed. a frame which takes longer
+//than pushWriteTimeout closes the connection.
+func (sc *serverConn) writePushes(q chan []byte) {
+	for body := range q {
+		if err := sc.writeTimeout(&frame{kind: kindPush, body: body}, pushWriteTimeout); err != nil {
+			log.ErrorLog("rpc_server: push to %s failed, close it. err:%s", sc.conn.RemoteAddr(), err)
+			sc.conn.Close()
+			//the end of the connection closes q
+			for range q {
+			}
+			return
+		}
+	}
+}
+
+//add or remove a subscription of the connection
+func (s *Server) subscribe(sc *serverConn, topic string, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, had := sc.topics[topic]
+	if add == had {
+		return
+	}
+	if add {
+		if sc.topics == nil {
+			sc.topics = make(map[string]struct{})
+		}
+		if s.subs == nil {
+			s.subs = make(map[string]map[*serverConn]struct{})
+		}
+		if s.subs[topic] == nil {
+			s.subs[topic] = make(map[*serverConn]struct{})
+		}
+		sc.topics[topic] = struct{}{}
+		s.subs[topic][sc] = struct{}{}
+		if len(sc.topics) == 1 {
+			//a subscribed connection is never idle
+			atomic.AddInt32(&sc.busy, 1)
+			if sc.pushes == nil {
+				sc.pushes = make(chan []byte, pushQueue)
+				go sc.writePushes(sc.pushes)
+			}
+		}
+		return
+	}
+	delete(sc.topics, topic)
+	delete(s.subs[topic], sc)
+	if len(s.subs[topic]) == 0 {
+		delete(s.subs, topic)
+	}
+	if len(sc.topics) == 0 {
+		sc.done()
+		//the queued messages still go out
+		if sc.pushes != nil {
+			close(sc.pushes)
+			sc.pushes = nil
+		}
+	}
+}
+
+//drop the subscriptions of a connection which went away
+func (s *Server) unsubscribeAll(sc *serverConn) {
+	s.mu.Lock()
+	topics := make([]string, 0, len(sc.topics))
+	for topic := range sc.topics {
+		topics = append(topics, topic)
+	}
+	s.mu.Unlock()
+	for _, topic := range topics {
+		s.subscribe(sc, topic, false)
+	}
+}
+
+//subscription of a client to a topic, made by Subscribe
+type Subscription struct {
+	c     *Client
+	topic string
+	fn    func(*Message)
+	queue chan *Message
+	stop  chan struct{}
+	once  sync.Once
+}
+
+//call fn with every message the servers publish on topic, one at a time
+//in the order they arrive. the client keeps one connection to every server
+//for the messages and dials it again when it breaks, messages published
+//while it is down are lost.
+func (c *Client) Subscribe(topic string, fn func(*Message)) (*Subscription, error) {
+	if topic == "" {
+		return nil, errors.New("rpc_client: empty topic")
+	}
+	sub := &Subscription{c: c, topic: topic, fn: fn, queue: make(chan *Message, pushQueue), stop: make(chan struct{})}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if c.subs == nil {
+		c.subs = make(map[string][]*Subscription)
+		c.kick = make(chan struct{}, 1)
+		go c.pushLoop()
+	}
+	first := len(c.subs[topic]) == 0
+	c.subs[topic] = append(c.subs[topic], sub)
+	eps := c.endpoints
+	c.mu.Unlock()
+	go sub.run()
+	if first {
+		for _, ep := range eps {
+			ep.sendSubscribe(topic, true)
+		}
+	}
+	//servers without a subscription connection get one now
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+	return sub, nil
+}
+
+//stop the subscription, the servers stop sending the topic once nobody
+//of the client listens to it
+func (sub *Subscription) Unsubscribe() {
+	sub.once.Do(func() {
+		close(sub.stop)
+		c := sub.c
+		c.mu.Lock()
+		subs := c.subs[sub.topic]
+		for i, s := range subs {
+			if s == sub {
+				subs = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		last := len(subs) == 0
+		if last {
+			delete(c.subs, sub.topic)
+		} else {
+			c.subs[sub.topic] = subs
+		}
+		eps := c.endpoints
+		c.mu.Unlock()
+		if last {
+			for _, ep := range eps {
+				ep.sendSubscribe(sub.topic, false)
+			}
+		}
+	})
+}
+
+//hand the queued messages to fn until the subscription or the client stops
+func (sub *Subscription) run() {
+	for {
+		select {
+		case m := <-sub.queue:
+			sub.fn(m)
+		case <-sub.stop:
+			return
+		case <-sub.c.stop:
+			return
+		}
+	}
+}
+
+//hand a pushed message to the subscriptions of its topic
+func (c *Client) deliver(m *Message) {
+	c.mu.Lock()
+	subs := c.subs[m.Topic]
+	c.mu.Unlock()
+	for _, sub := range subs {
+		select {
+		case sub.queue <- m:
+		default:
+			log.ErrorLog("rpc_client: subscription of %s is full, drop a message", m.Topic)
+		}
+	}
+}
+
+//the topics subscribed now
+func (c *Client) topics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.subs))
+	for topic := range c.subs {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+//keep a subscription connection to every server until the client is closed
+func (c *Client) pushLoop() {
+	interval := c.opts.heartbeat
+	if interval <= 0 {
+		interval = defaultPushInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		case <-c.kick:
+		}
+		for _, ep := range c.getEndpoints() {
+			ep.checkPush(c)
+		}
+	}
+}
+
+//dial the subscription connection of the server when it has none, or
+//ping it when heartbeats are on
+func (ep *endpoint) checkPush(c *Client) {
+	ep.mu.Lock()
+	cc := ep.push
+	closed := ep.closed
+	ep.mu.Unlock()
+	if closed {
+		return
+	}
+	if cc != nil && !cc.broken() {
+		if ep.opts.heartbeat <= 0 {
+			return
+		}
+		err := cc.ping(ep.opts.heartbeatTimeout)
+		if err == nil {
+			return
+		}
+		log.ErrorLog("rpc_client: ping subscription connection of %s failed. err:%s", ep.addr, err)
+		cc.conn.Close()
+	}
+	cc, err := ep.dial(context.Background())
+	if err != nil {
+		log.ErrorLog("rpc_client: dial subscription connection of %s failed. err:%s", ep.addr, err)
+		return
+	}
+	cc.setPush(func(f *frame) {
+		topic, data, err := decodePush(f.body)
+		if err != nil {
+			log.ErrorLog("rpc_client: bad push frame from %s. err:%s", ep.addr, err)
+			return
+		}
+		c.deliver(&Message{Topic: topic, Data: data, codec: cc.codec})
+	})
+	ep.mu.Lock()
+	if ep.closed {
+		ep.mu.Unlock()
+		cc.conn.Close()
+		return
+	}
+	ep.push = cc
+	ep.mu.Unlock()
+	//topics subscribed from now on are sent by Subscribe
+	for _, topic := range c.topics() {
+		ep.sendSubscribe(topic, true)
+	}
+}
+
+//tell the server to start or stop sending topic
+func (ep *endpoint) sendSubscribe(topic string, add bool) {
+	ep.mu.Lock()
+	cc := ep.push
+	ep.mu.Unlock()
+	if cc == nil || cc.broken() {
+		//sent when the connection is dialed
+		return
+	}
+	kind := kindUnsubscribe
+	if add {
+		kind = kindSubscribe
+	}
+	cc.write(&frame{kind: kind, body: []byte(topic)}, time.Now().Add(handshakeTimeout))
+}
+
+//route the push frames of the connection to fn
+func (cc *clientConn) setPush(fn func(*frame)) {
+	cc.mu.Lock()
+	cc.push = fn
+	cc.mu.Unlock()
+}
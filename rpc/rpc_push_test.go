@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type userEvent struct{ User, Kind string }
+
+//subscribers of topic on the server
+func subscribers(s *Server, topic string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs[topic])
+}
+
+//wait until the server has n subscribers of topic
+func waitSubscribers(t *testing.T, s *Server, topic string, n int) {
+	t.Helper()
+	for i := 0; subscribers(s, topic) != n; i++ {
+		if i == 100 {
+			t.Fatalf("%d subscribers of %s, want %d", subscribers(s, topic), topic, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s := NewServer(WithIdleTimeout(50 * time.Millisecond))
+	RegisterFunc(s, "Rename", func(ctx context.Context, r nameReq) (addRes, error) {
+		s.Publish("user", userEvent{r.Name, "nick"})
+		return addRes{}, nil
+	})
+	addr := serve(t, s)
+	for _, name := range codecNames {
+		c := newTestClient(t, addr, WithCodecs(name))
+		got := make(chan userEvent, 10)
+		sub, err := c.Subscribe("user", func(m *Message) {
+			var e userEvent
+			if err := m.Decode(&e); err != nil {
+				t.Error(err)
+			}
+			got <- e
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitSubscribers(t, s, "user", 1)
+		if err := c.Call("Rename", nameReq{"bob"}, &addRes{}); err != nil {
+			t.Fatal(err)
+		}
+		if e := <-got; e != (userEvent{"bob", "nick"}) {
+			t.Fatal(name, e)
+		}
+		//the idle timeout leaves the subscription connection alone
+		time.Sleep(150 * time.Millisecond)
+		if n, err := s.Publish("user", userEvent{"amy", "logout"}); n != 1 || err != nil {
+			t.Fatal(name, n, err)
+		}
+		if e := <-got; e.User != "amy" {
+			t.Fatal(name, e)
+		}
+		sub.Unsubscribe()
+		waitSubscribers(t, s, "user", 0)
+		if n, _ := s.Publish("user", userEvent{"amy", "logout"}); n != 0 {
+			t.Fatalf("published to %d after unsubscribe", n)
+		}
+	}
+}
+
+//a client which subscribes and then reads nothing
+func stuckSubscriber(t *testing.T, addr string, topic string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	f, _ := helloFrame(hello{Version: frameVersion, MaxFrameSize: DefaultMaxFrameSize})
+	writeFrame(conn, f)
+	if _, err := readFrame(bufio.NewReader(conn), DefaultMaxFrameSize); err != nil {
+		t.Fatal(err)
+	}
+	writeFrame(conn, &frame{kind: kindSubscribe, body: []byte(topic)})
+	return conn
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	s := NewServer()
+	addr := serve(t, s)
+	c := newTestClient(t, addr)
+	got := make(chan string, 1)
+	if _, err := c.Subscribe("user", func(m *Message) { got <- string(m.Data) }); err != nil {
+		t.Fatal(err)
+	}
+	stuckSubscriber(t, addr, "user")
+	waitSubscribers(t, s, "user", 2)
+	//far more than the socket buffers and the queue hold. the healthy
+	//subscriber reads every message before the next one.
+	big := strings.Repeat("x", 64<<10)
+	for i := 0; i < 300; i++ {
+		start := time.Now()
+		s.Publish("user", big)
+		if took := time.Since(start); took > 100*time.Millisecond {
+			t.Fatalf("publish waited %s for the subscriber", took)
+		}
+		<-got
+	}
+	//the stuck one is closed, the other one goes on
+	waitSubscribers(t, s, "user", 1)
+	if n, err := s.Publish("user", "hi"); n != 1 || err != nil {
+		t.Fatal(n, err)
+	}
+	if m := <-got; m != `"hi"` {
+		t.Fatal(m)
+	}
+}
@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//name of the built-in method which lists the methods of the server
+const MethodsName = "rpc.Methods"
+
+//request of MethodsName
+type MethodsReq struct{}
+
+//response of MethodsName
+type MethodsRes struct {
+	Methods []MethodInfo `json:"methods"`
+}
+
+//what a registered method takes and returns
+type MethodInfo struct {
+	Name     string  `json:"name"`
+	Stream   bool    `json:"stream,omitempty"` //registered by RegisterStream
+	Request  *Schema `json:"request"`
+	Response *Schema `json:"response"`
+}
+
+//shape of a request or response, or of one of their fields
+type Schema struct {
+	Name   string    `json:"name,omitempty"`   //json key of the field, empty for the top level
+	Type   string    `json:"type"`             //go type, like utils.ReqLogin or []string
+	Fields []*Schema `json:"fields,omitempty"` //fields of a struct, of the elements for slices and maps
+}
+
+//register MethodsName on the server
+func registerMethods(s *Server) {
+	RegisterFunc(s, MethodsName, func(ctx context.Context, _ MethodsReq) (MethodsRes, error) {
+		return MethodsRes{Methods: s.Methods()}, nil
+	})
+}
+
+//the registered methods sorted by name, MethodsName itself is left out
+func (s *Server) Methods() []MethodInfo {
+	methods := make([]MethodInfo, 0, len(s.Se))
+	for name, h := range s.Se {
+		if name == MethodsName {
+			continue
+		}
+		methods = append(methods, MethodInfo{
+			Name:     name,
+			Stream:   h.stream,
+			Request:  schemaOf(h.reqType, nil),
+			Response: schemaOf(h.resType, nil),
+		})
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Name < methods[j].Name })
+	return methods
+}
+
+//list the methods of the server a call goes to
+func (c *Client) Methods(ctx context.Context) ([]MethodInfo, error) {
+	var res MethodsRes
+	if err := c.CallContext(ctx, MethodsName, MethodsReq{}, &res); err != nil {
+		return nil, err
+	}
+	return res.Methods, nil
+}
+
+//describe t, seen holds the structs being described to stop at recursive types
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	sc := &Schema{Type: t.String()}
+	//fields of []T, *T and map[K]T are the ones of T
+	elem := t
+	for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array || elem.Kind() == reflect.Map {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct || seen[elem] {
+		return sc
+	}
+	if seen == nil {
+		seen = make(map[reflect.Type]bool)
+	}
+	seen[elem] = true
+	defer delete(seen, elem)
+	for i := 0; i < elem.NumField(); i++ {
+		f := elem.Field(i)
+		if f.PkgPath != "" {
+			//codecs skip unexported fields
+			continue
+		}
+		name := f.Name
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			key := strings.Split(tag, ",")[0]
+			if key == "-" {
+				continue
+			}
+			if key != "" {
+				name = key
+			}
+		}
+		fs := schemaOf(f.Type, seen)
+		fs.Name = name
+		sc.Fields = append(sc.Fields, fs)
+	}
+	return sc
+}
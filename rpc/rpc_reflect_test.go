@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+type treeNode struct {
+	Value    int         `json:"value"`
+	Children []*treeNode `json:"children"`
+	Skip     string      `json:"-"`
+	hidden   int
+}
+
+func TestMethods(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", add)
+	RegisterFunc(s, "Tree", func(ctx context.Context, r treeNode) (map[string][]treeNode, error) {
+		return nil, nil
+	})
+	RegisterStream(s, "Up", func(ctx context.Context, r nameReq, st *ServerStream) (addRes, error) {
+		return addRes{}, nil
+	})
+	addr := serve(t, s)
+	want := s.Methods()
+	if len(want) != 3 || want[0].Name != "Add" || want[1].Name != "Tree" || want[2].Name != "Up" || !want[2].Stream || want[0].Stream {
+		t.Fatalf("got %+v", want)
+	}
+	tree := want[1].Request
+	if tree.Type != "rpc.treeNode" || len(tree.Fields) != 2 || tree.Fields[0].Name != "value" || tree.Fields[1].Name != "children" {
+		t.Fatalf("request of Tree: %+v", tree)
+	}
+	//the recursive type stops at itself
+	if children := tree.Fields[1]; children.Type != "[]*rpc.treeNode" || children.Fields != nil {
+		t.Fatalf("children of Tree: %+v", children)
+	}
+	if res := want[1].Response; res.Type != "map[string][]rpc.treeNode" || len(res.Fields) != 2 {
+		t.Fatalf("response of Tree: %+v", res)
+	}
+	wantJSON, _ := json.Marshal(want)
+	for _, name := range codecNames {
+		got, err := newTestClient(t, addr, WithCodecs(name)).Methods(context.Background())
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		//binary decodes empty field lists as empty slices, not nil
+		if b, _ := json.Marshal(got); string(b) != string(wantJSON) {
+			t.Fatalf("%s: got %s", name, b)
+		}
+	}
+}
+
+//a client without the go types calls with raw json
+func TestCallRawJSON(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s), WithCodecs("json"))
+	var res json.RawMessage
+	if err := c.Call("Add", json.RawMessage(`{"A":1,"B":2}`), &res); err != nil || string(res) != `{"Sum":3}` {
+		t.Fatalf("got %s, %v", res, err)
+	}
+}
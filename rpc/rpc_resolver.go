@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"GoUserManaSys/log"
+
+	"gopkg.in/ini.v1"
+)
+
+//how long the client waits for one resolve
+const resolveTimeout = 5 * time.Second
+
+//re-resolve interval of the client by default
+const defaultResolveInterval = 30 * time.Second
+
+//finds the addresses of the servers. the client resolves again every
+//resolve interval, servers which appear are dialed on demand and servers
+//which disappear are closed once their calls finish.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+//set how often the client asks the resolver again
+func WithResolveInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.resolveInterval = d
+	}
+}
+
+type staticResolver []string
+
+//the same addresses every time
+func StaticResolver(addrs ...string) Resolver {
+	return staticResolver(addrs)
+}
+
+func (r staticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+type srvResolver struct {
+	name string
+}
+
+//the targets of the DNS SRV record name, like _rpc._tcp.example.com
+func SRVResolver(name string) Resolver {
+	return &srvResolver{name: name}
+}
+
+func (r *srvResolver) Resolve(ctx context.Context) ([]string, error) {
+	_, srvs, err := net.DefaultResolver.LookupSRV(ctx, "", "", r.name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+	}
+	return addrs, nil
+}
+
+type fileResolver struct {
+	path string
+}
+
+//the addresses listed in a file which is read again on every resolve, so
+//editing it adds or drains servers. a .json file holds an array of
+//addresses or {"endpoints": [...]}, any other file is ini with a top level
+//key endpoints separated by comma.
+func FileResolver(path string) Resolver {
+	return &fileResolver{path: path}
+}
+
+func (r *fileResolver) Resolve(ctx context.Context) ([]string, error) {
+	if filepath.Ext(r.path) != ".json" {
+		f, err := ini.Load(r.path)
+		if err != nil {
+			return nil, err
+		}
+		return f.Section("").Key("endpoints").Strings(","), nil
+	}
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	if err = json.Unmarshal(b, &addrs); err == nil {
+		return addrs, nil
+	}
+	var obj struct {
+		Endpoints []string `json:"endpoints"`
+	}
+	if err = json.Unmarshal(b, &obj); err != nil {
+		return nil, fmt.Errorf("rpc_client: bad endpoints file %s: %v", r.path, err)
+	}
+	return obj.Endpoints, nil
+}
+
+//ask the resolver once
+func resolve(r Resolver) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	return r.Resolve(ctx)
+}
+
+//resolve again every interval until the client is closed
+func (c *Client) watch(r Resolver) {
+	t := time.NewTicker(c.opts.resolveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+		addrs, err := resolve(r)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no server address")
+		}
+		if err != nil {
+			//keep the servers known so far
+			log.ErrorLog("rpc_client: resolve failed. err:%s", err)
+			continue
+		}
+		added, err := c.setEndpoints(addrs)
+		if err != nil {
+			log.ErrorLog("rpc_client: resolve failed. err:%s", err)
+		}
+		for _, ep := range added {
+			go ep.fill()
+		}
+	}
+}
+
+//make addrs the servers of the client and return the new ones. known
+//servers keep their connections and missing ones are retired. empty and
+//repeated addresses are skipped, it fails only when no address is left.
+func (c *Client) setEndpoints(addrs []string) ([]*endpoint, error) {
+	var added []*endpoint
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	old := make(map[string]*endpoint, len(c.endpoints))
+	for _, ep := range c.endpoints {
+		old[ep.Addr()] = ep
+	}
+	eps := make([]*endpoint, 0, len(addrs))
+	seen := make(map[string]bool, len(addrs))
+	for _, add := range addrs {
+		add = strings.TrimSpace(add)
+		if add == "" || seen[add] {
+			continue
+		}
+		seen[add] = true
+		if ep, ok := old[add]; ok {
+			delete(old, add)
+			eps = append(eps, ep)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(add)
+		if host == "" {
+			//":3000" is this machine
+			host = "localhost"
+		}
+		ep := newEndpoint(add, host, &c.opts)
+		eps = append(eps, ep)
+		added = append(added, ep)
+	}
+	if len(eps) == 0 {
+		//never leave the client without a server
+		return nil, errors.New("no server address")
+	}
+	for _, ep := range old {
+		log.InfoLog("rpc_client: server %s removed, close it after its calls", ep.addr)
+		ep.retire()
+	}
+	//the slice is replaced, never changed, getEndpoints hands it out
+	c.endpoints = eps
+	if w, ok := c.opts.balancer.(endpointsWatcher); ok {
+		all := make([]Endpoint, len(eps))
+		for i, ep := range eps {
+			all[i] = ep
+		}
+		w.setEndpoints(all)
+	}
+	return added, nil
+}
@@ -0,0 +1,83 @@
+package rpc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//servers answering calls to c, by index
+func whoAnswers(t *testing.T, c *Client) map[int]bool {
+	t.Helper()
+	m := map[int]bool{}
+	for i := 0; i < 6; i++ {
+		m[who(t, c, "")] = true
+	}
+	return m
+}
+
+func TestFileResolverWatched(t *testing.T) {
+	_, addrs := whoServers(t, 2)
+	path := filepath.Join(t.TempDir(), "endpoints.json")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	write(`["` + addrs[0] + `"]`)
+	c, err := NewResolverClient(2, FileResolver(path), WithResolveInterval(30*time.Millisecond), WithPool(PoolConfig{MinConns: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if m := whoAnswers(t, c); len(m) != 1 || !m[0] {
+		t.Fatal(m)
+	}
+	write(`{"endpoints":["` + addrs[0] + `","` + addrs[1] + `"]}`)
+	if m := whoAnswers(t, c); len(m) != 2 {
+		t.Fatal(m)
+	}
+	write(`["` + addrs[1] + `"]`)
+	if m := whoAnswers(t, c); len(m) != 1 || !m[1] {
+		t.Fatal(m)
+	}
+	//an empty list keeps the servers known so far
+	write(`[]`)
+	if m := whoAnswers(t, c); len(m) != 1 || !m[1] {
+		t.Fatal(m)
+	}
+}
+
+func TestFileResolverIni(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.ini")
+	os.WriteFile(path, []byte("endpoints = 127.0.0.1:3000, 127.0.0.1:3001\n"), 0644)
+	got, err := FileResolver(path).Resolve(context.Background())
+	if err != nil || len(got) != 2 || got[1] != "127.0.0.1:3001" {
+		t.Fatal(got, err)
+	}
+}
+
+func TestSetEndpoints(t *testing.T) {
+	_, addrs := whoServers(t, 2)
+	c := newTestMultiClient(t, addrs[:1])
+	//repeated and empty addresses are skipped, not reported
+	added, err := c.setEndpoints([]string{addrs[0], addrs[1], " ", addrs[1], ""})
+	if err != nil || len(added) != 1 || len(c.getEndpoints()) != 2 {
+		t.Fatalf("added %d, %d endpoints, err %v", len(added), len(c.getEndpoints()), err)
+	}
+	if _, err := c.setEndpoints([]string{"", " "}); err == nil {
+		t.Fatal("list without an address accepted")
+	}
+	if len(c.getEndpoints()) != 2 {
+		t.Fatal("servers dropped by a bad list")
+	}
+}
+
+func TestSRVResolverFails(t *testing.T) {
+	if _, err := SRVResolver("_nope._tcp.invalid").Resolve(context.Background()); err == nil {
+		t.Fatal("unknown SRV record resolved")
+	}
+}
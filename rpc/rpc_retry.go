@@ -0,0 +1,72 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//when and how the client calls again after a failed attempt
+type RetryPolicy struct {
+	MaxAttempts int                  //attempts including the first one, 1 or less means no retry
+	Backoff     time.Duration        //wait before the first retry, doubled for every next one
+	MaxBackoff  time.Duration        //upper bound of the wait, 0 means no bound
+	Retryable   func(err error) bool //errors worth another attempt, nil means connection errors
+	Idempotent  []string             //methods which may run twice, only they are retried after the request went out
+}
+
+//connection errors and errors the server marked retryable are worth another attempt
+func defaultRetryable(err error) bool {
+	var ce *ConnError
+	if errors.As(err, &ce) {
+		return true
+	}
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
+
+//whether the failed attempt may be sent again
+func (p *RetryPolicy) retry(method string, err error) bool {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = defaultRetryable
+	}
+	if !retryable(err) {
+		return false
+	}
+	//the server may have run it already
+	var ce *ConnError
+	if errors.As(err, &ce) && ce.Sent && !containsString(p.Idempotent, method) {
+		return false
+	}
+	return true
+}
+
+//wait before attempt n, n starts from 1 for the first retry
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+//call until an attempt succeeds, the policy gives up or ctx is done
+func (c *Client) invokeRetry(ctx context.Context, method string, req interface{}, res interface{}) error {
+	p := c.opts.retry
+	err := c.invoke(ctx, method, req, res)
+	for n := 1; n < p.MaxAttempts && err != nil && ctx.Err() == nil && p.retry(method, err); n++ {
+		t := time.NewTimer(p.backoff(n))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		err = c.invoke(ctx, method, req, res)
+	}
+	return err
+}
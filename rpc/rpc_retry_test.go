@@ -0,0 +1,63 @@
+package rpc
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBrokenConnections(t *testing.T) {
+	s := NewServer()
+	var attempts int32
+	started := make(chan struct{})
+	broken := make(chan struct{})
+	RegisterFunc(s, "Add", func(ctx context.Context, r addReq) (addRes, error) {
+		//the first attempt loses its connection before it answers
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			close(started)
+			<-broken
+		}
+		return addRes{r.A + r.B}, nil
+	})
+	var seen int32
+	c := newTestClient(t, serve(t, s), WithRetry(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, Idempotent: []string{"Add"}}),
+		WithClientInterceptors(func(ctx context.Context, method string, req, res interface{}, invoke Invoker) error {
+			atomic.AddInt32(&seen, 1)
+			return invoke(ctx, method, req, res)
+		}))
+	go func() {
+		<-started
+		ep := c.getEndpoints()[0]
+		ep.mu.Lock()
+		for _, cc := range ep.conns {
+			cc.conn.Close()
+		}
+		ep.mu.Unlock()
+		close(broken)
+	}()
+	var res addRes
+	if err := c.Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err, res)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Fatalf("server got %d attempts, want 2", n)
+	}
+	//interceptors run once per call, not once per attempt
+	if n := atomic.LoadInt32(&seen); n != 1 {
+		t.Fatalf("interceptor ran %d times, want 1", n)
+	}
+	c.Close()
+	if err := c.Call("Add", addReq{1, 2}, &res); err != ErrClientClosed {
+		t.Fatalf("got %v, want client closed", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{1: 10 * time.Millisecond, 3: 40 * time.Millisecond, 9: 50 * time.Millisecond} {
+		if got := p.backoff(attempt); got != want {
+			t.Fatalf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
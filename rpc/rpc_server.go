@@ -1,44 +1,91 @@
 package rpc
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"reflect"
-	"strconv"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"GoUserManaSys/log"
 )
 
-const TcpHeadMaxSize int = 4
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 //use map struct to reflect the handle name and handle function
 type Server struct {
-	Se map[string]Handler
+	Se           map[string]Handler
+	opts         options
+	interceptors []Interceptor
+
+	mu        sync.Mutex //protect the fields below
+	listeners map[net.Listener]struct{}
+	conns     map[*serverConn]struct{}
+	shutdown  bool
+	active    int           //requests being handled
+	idle      chan struct{} //made by Shutdown, closed when active drops to 0
+
+	subs map[string]map[*serverConn]struct{} //subscribed connections by topic, guarded by mu
+
+	lMu      sync.Mutex          //protect limiters
+	limiters map[string]*limiter //limiters of the methods called so far
+
+	batchSlots chan struct{} //taken by every batch item running
 }
 
 type serveFunc func(interface{}) interface{}
 
+//serve function which gets the context of the call
+type serveCtxFunc func(context.Context, interface{}) interface{}
+
 //request struct
 type Handler struct {
-	intfc   serveFunc    //request func
+	intfc   HandlerFunc  //request func
 	reqType reflect.Type //request type
 	resType reflect.Type //response type
+	stream  bool         //registered by RegisterStream
 }
 
 //client request struct
 type Request struct {
 	ReqName string `json:"reqName"` //client request name
 	ReqData []byte `json:"reqDate"` //client request data
+	Timeout int64  `json:"timeout"` //nanoseconds left before the caller's deadline, 0 means no deadline
 }
 
 //init Server
-func NewServer() Server {
-	return Server{make(map[string]Handler)}
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		Se:        make(map[string]Handler),
+		opts:      newOptions(opts),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*serverConn]struct{}),
+	}
+	s.batchSlots = make(chan struct{}, s.opts.batchWorkers)
+	//callers can ask what the server exposes
+	registerMethods(s)
+	return s
 }
 
 //rpc register function, get handle by handler ,get actual args type by serv.
 func (s *Server) Register(name string, handler serveFunc, serv interface{}) error {
+	return s.RegisterContext(name, func(_ context.Context, f interface{}) interface{} {
+		return handler(f)
+	}, serv)
+}
+
+//register a handler which gets the context of the call, the context is done
+//when the caller's deadline passes or its connection goes away.
+//serv is func(Req) Res or func(context.Context, Req) Res.
+func (s *Server) RegisterContext(name string, handler serveCtxFunc, serv interface{}) error {
 	//get type of service by reflect
 	servType := reflect.TypeOf(serv)
 	//check the request type
@@ -46,145 +93,318 @@ func (s *Server) Register(name string, handler serveFunc, serv interface{}) erro
 		return err
 	}
 	//get type of args and response
-	reqType := servType.In(0)
+	reqType := servType.In(servType.NumIn() - 1)
 	resType := servType.Out(0)
 	//save [name,Handle] map
-	s.Se[name] = Handler{intfc: handler, reqType: reqType, resType: resType}
+	s.Se[name] = Handler{intfc: func(ctx context.Context, req interface{}) (interface{}, error) {
+		return handler(ctx, req), nil
+	}, reqType: reqType, resType: resType}
 	return nil
 }
 
-//rpc listen function, listen the address
-func (s *Server) Listen(address string) (*net.TCPListener, error) {
-	addr, err := net.ResolveTCPAddr("tcp4", address)
-	if err != nil {
-		return nil, err
-	}
-	listen, err := net.ListenTCP("tcp4", addr)
-	if err != nil {
-		return nil, err
-	}
-	return listen, nil
+//rpc listen function, listen the address with the transport of the server
+func (s *Server) Listen(address string) (net.Listener, error) {
+	return s.opts.transport.Listen(address)
 }
 
 //serve function
-func (s *Server) Serve(l *net.TCPListener) error {
+func (s *Server) Serve(l net.Listener) error {
 	if err := s.accept(l); err != nil {
 		return err
 	}
 	return nil
 }
 
-//read the data from rpc client, handle and return
-func (s *Server) Handle(conn *net.TCPConn) error {
+//read the data from rpc client, handle and return.
+//every request is handled in its own goroutine, so one connection carries
+//many concurrent calls and the responses may be sent back out of order.
+func (s *Server) Handle(conn net.Conn) error {
 	if conn == nil {
 		return errors.New("rpc_server:connect is null")
 	}
-	dLen := make([]byte, TcpHeadMaxSize)
-	for {
-		n, err := conn.Read(dLen)
-		if err != io.EOF && err != nil {
-			errors.New("rpc_server:read connect failed")
-		}
-		if n <= 0 {
-			errors.New("rpc_server:no data")
+	defer conn.Close()
+	if s.opts.tls != nil {
+		tc, ok := conn.(*tls.Conn)
+		if !ok {
+			tc = tls.Server(conn, s.opts.tls)
+			conn = tc
 		}
-		l, err := strconv.ParseInt(string(dLen[:TcpHeadMaxSize]), 10, 64)
-		if err != nil {
+		if err := tlsHandshake(tc); err != nil {
 			return err
 		}
-		//get the data of l length pack
-		b := make([]byte, l)
-		n, err = conn.Read(b)
-		if err != nil {
-			return errors.New("rpc_server: connection read body failed")
+	}
+	//calls of this connection are canceled once it goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc := &serverConn{s: s, conn: conn, r: bufio.NewReader(conn), cancel: cancel}
+	if !s.trackConn(sc, true) {
+		return ErrServerClosed
+	}
+	defer s.trackConn(sc, false)
+	defer s.unsubscribeAll(sc)
+	sc.touch()
+	if s.opts.idleTimeout > 0 {
+		go sc.watchIdle(ctx, s.opts.idleTimeout)
+	}
+	magic, err := sc.r.Peek(2)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	//clients built before the binary frame send the ascii length header
+	if binary.BigEndian.Uint16(magic) != frameMagic {
+		//they can't answer a challenge
+		if s.opts.auth != nil {
+			return fmt.Errorf("rpc_server: old client %s can't authenticate", conn.RemoteAddr())
 		}
-		if n <= 0 {
-			return errors.New("rpc_server: no data")
+		return s.handleLegacy(ctx, sc)
+	}
+	if err = sc.handshake(); err != nil {
+		return err
+	}
+	for {
+		f, err := readFrame(sc.r, s.opts.maxFrameSize)
+		if err == io.EOF {
+			return nil
 		}
-		//handle the request
-		resp, err := s.find(b)
 		if err != nil {
 			return err
 		}
-		//pack the response data to the json format
-		respJ, err := s.ToJson(resp)
-		if err != nil {
+		if err = sc.compress.unpack(f, s.opts.maxFrameSize); err != nil {
 			return err
 		}
-		conn.Write(respJ) //send the result
+		sc.touch()
+		if f.kind == kindPing {
+			sc.write(&frame{kind: kindPong, id: f.id})
+			continue
+		}
+		if f.kind == kindStreamOpen {
+			sc.openStream(ctx, f)
+			continue
+		}
+		if f.kind == kindStreamData || f.kind == kindStreamWindow || f.kind == kindStreamEnd {
+			sc.streamFrame(f)
+			continue
+		}
+		if f.kind == kindSubscribe || f.kind == kindUnsubscribe {
+			s.subscribe(sc, string(f.body), f.kind == kindSubscribe)
+			continue
+		}
+		if f.kind == kindBatch {
+			sc.batch(ctx, f)
+			continue
+		}
+		if f.kind != kindRequest {
+			return fmt.Errorf("rpc_server: unexpected frame kind %d", f.kind)
+		}
+		req, err := decodeRequest(f.body)
+		if err != nil {
+			sc.writeError(f.id, Errorf(CodeBadRequest, "bad request body: %v", err))
+			continue
+		}
+		//counted here, before the next read, so Shutdown never misses it
+		if !s.begin() {
+			sc.writeError(f.id, errShuttingDown)
+			continue
+		}
+		atomic.AddInt32(&sc.busy, 1)
+		go sc.serve(ctx, f.id, req)
 	}
 }
 
-//find the Handle interface to handle the request by its name
-func (s *Server) find(data []byte) (interface{}, error) {
-	//parse the interface name
-	var req Request
-	err := json.Unmarshal(data, &req)
+//one connection of the server
+type serverConn struct {
+	last int64 //unix nano of the last frame or finished request, first for 64-bit atomic alignment
+	busy int32 //requests of the connection being handled
+
+	s      *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	cancel context.CancelFunc //cancel the calls of the connection
+
+	wMu          sync.Mutex  //responses of concurrent requests share the connection
+	ready        bool        //handshake done, the client understands frames
+	peerMaxFrame uint32      //biggest frame body the client accepts
+	codec        Codec       //codec picked in the handshake
+	compress     compression //compressor picked in the handshake, set before the requests are read
+
+	sMu     sync.Mutex               //protect streams
+	streams map[uint64]*ServerStream //open streams by id
+
+	topics map[string]struct{} //topics the client subscribed, guarded by s.mu
+	pushes chan []byte         //push bodies for writePushes while subscribed, guarded by s.mu
+}
+
+//answer the hello of the client with the version, frame size and codec to use
+func (sc *serverConn) handshake() error {
+	sc.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	f, err := readFrame(sc.r, sc.s.opts.maxFrameSize)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	//get the Handler by req name
-	r, ok := s.Se[req.ReqName]
-	if !ok {
-		return nil, errors.New("rpc_server:don't find handler")
+	h, err := parseHello(f)
+	if err != nil {
+		return err
 	}
-	//pares data type, get data by this type. save to reqType, reqType is Handle args
-	reqType := reflect.New(r.reqType).Interface()
-	err = json.Unmarshal(req.ReqData, reqType)
+	sc.conn.SetReadDeadline(time.Time{})
+	sc.peerMaxFrame = h.MaxFrameSize
+	if h.Version > frameVersion {
+		h.Version = frameVersion
+	}
+	//clients which offer nothing speak json
+	if len(h.Codecs) == 0 {
+		h.Codecs = []string{JSONCodec{}.Name()}
+	}
+	if sc.codec, err = chooseCodec(h.Codecs, sc.s.opts.codecs); err != nil {
+		return err
+	}
+	//a server with keys challenges the client
+	var nonce []byte
+	if sc.s.opts.auth != nil {
+		if nonce, err = newNonce(); err != nil {
+			return err
+		}
+	}
+	//old clients and servers without WithCompression stay uncompressed
+	reply := hello{Version: h.Version, MaxFrameSize: sc.s.opts.maxFrameSize, Codec: sc.codec.Name(), Nonce: nonce}
+	comp := chooseCompressor(h.Compressors, sc.s.opts.compressors)
+	if comp != nil {
+		reply.Compressor = comp.Name()
+	}
+	f, err = helloFrame(reply)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return r.intfc(reqType), nil
-}
-func (s *Server) ToJson(f interface{}) ([]byte, error) {
-	return toJsons(f)
+	if err = sc.write(f); err != nil {
+		return err
+	}
+	if nonce != nil {
+		if err = sc.authenticate(nonce); err != nil {
+			return err
+		}
+	}
+	sc.wMu.Lock()
+	sc.ready = true
+	if comp != nil {
+		sc.compress = compression{c: comp, threshold: sc.s.opts.compressThreshold}
+	}
+	sc.wMu.Unlock()
+	return nil
 }
 
-//pack the interface to json format and return
-func toJsons(f interface{}) ([]byte, error) {
-	b, err := json.Marshal(f)
+//handle one request and write the response back with the request id
+func (sc *serverConn) serve(ctx context.Context, id uint64, req Request) {
+	defer sc.s.end()
+	defer sc.done()
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout))
+		defer cancel()
+	}
+	//the caller has already gone away, skip the work
+	if ctx.Err() != nil {
+		return
+	}
+	resp, err := sc.s.find(ctx, sc.codec, req)
+	var data []byte
+	if err == nil {
+		data, err = sc.codec.Marshal(resp)
+		if err != nil {
+			err = Errorf(CodeInternal, "encode response: %v", err)
+		} else if uint32(len(data)) > sc.peerMaxFrame {
+			err = Errorf(CodeInternal, "response of %d bytes is bigger than the client accepts", len(data))
+		}
+	}
+	//nobody is waiting for the result any more
+	if ctx.Err() != nil {
+		return
+	}
 	if err != nil {
-		return nil, err
+		//the error goes back instead of the response
+		sc.writeError(id, toError(err))
+		return
 	}
-	l := len(b)
-	//convert int to string
-	lStr := strconv.Itoa(l)
+	sc.write(&frame{kind: kindResponse, id: id, body: data})
+}
+
+//answer the request with an error
+func (sc *serverConn) writeError(id uint64, e *Error) error {
+	return sc.write(&frame{kind: kindResponse, flags: flagError, id: id, body: encodeError(e)})
+}
+
+//send a frame to the client
+func (sc *serverConn) write(f *frame) error {
+	//compressed outside the lock, other responses go out meanwhile
+	f = sc.compress.pack(f)
+	sc.wMu.Lock()
+	defer sc.wMu.Unlock()
+	return writeFrame(sc.conn, f)
+}
+
+//send a frame to the client, giving up after d
+func (sc *serverConn) writeTimeout(f *frame, d time.Duration) error {
+	f = sc.compress.pack(f)
+	sc.wMu.Lock()
+	defer sc.wMu.Unlock()
+	sc.conn.SetWriteDeadline(time.Now().Add(d))
+	defer sc.conn.SetWriteDeadline(time.Time{})
+	return writeFrame(sc.conn, f)
+}
 
-	iL := len(lStr)
-	//l := len(strconv.Itoa(len(b)))
-	//l size,compare with teh TcpHeadMaxSize
-	if iL > TcpHeadMaxSize {
-		return nil, errors.New("rpc_server: header is too big")
-		fmt.Println("rpc_server: header is too big")
+//find the Handle interface to handle the request by its name
+//a panic of the handler is recovered here and answered as an internal error,
+//so other calls of the connection and of the process carry on
+func (s *Server) find(ctx context.Context, codec Codec, req Request) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.ErrorLog("rpc_server: %s panic: %v\n%s", req.ReqName, p, debug.Stack())
+			resp, err = nil, Errorf(CodeInternal, "%s panic: %v", req.ReqName, p)
+		}
+	}()
+	//get the Handler by req name
+	r, ok := s.Se[req.ReqName]
+	if !ok {
+		return nil, Errorf(CodeMethodNotFound, "rpc_server:don't find handler %q", req.ReqName)
+	}
+	if _, ok := ctx.Value(streamKey{}).(*ServerStream); ok != r.stream {
+		if r.stream {
+			return nil, Errorf(CodeBadRequest, "rpc_server:%q is a stream, open it with NewStream", req.ReqName)
+		}
+		return nil, Errorf(CodeBadRequest, "rpc_server:%q is not a stream", req.ReqName)
 	}
-	iL = iL - 1
-	tb := []byte("0")
-	j := make([]byte, TcpHeadMaxSize+l)
-	//request head
-	for i := TcpHeadMaxSize - 1; i >= 0; i-- {
-		if iL < 0 {
-			j[i] = tb[0]
-		} else {
-			j[i] = []byte(lStr)[iL]
-			iL = iL - 1
+	//refused before the request is even decoded
+	if l := s.limiter(req.ReqName); l != nil {
+		if e := l.acquire(req.ReqName); e != nil {
+			return nil, e
 		}
+		defer l.release()
 	}
-	//request body
-	for i := 0; i < l; i++ {
-		j[TcpHeadMaxSize+i] = b[i]
+	//pares data type, get data by this type. save to reqType, reqType is Handle args
+	reqType := reflect.New(r.reqType).Interface()
+	err = codec.Unmarshal(req.ReqData, reqType)
+	if err != nil {
+		return nil, Errorf(CodeBadRequest, "decode %s request: %v", req.ReqName, err)
 	}
-	return j, nil
+	return s.invoke(ctx, r, req.ReqName, reqType)
 }
 
 //accept new request
-func (s *Server) accept(listen *net.TCPListener) error {
+func (s *Server) accept(listen net.Listener) error {
 	defer listen.Close()
+	if !s.trackListener(listen, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(listen, false)
 	for {
-		conn, err := listen.AcceptTCP()
+		conn, err := listen.Accept()
 		if err != nil {
+			if s.closing() {
+				return ErrServerClosed
+			}
 			return err
 		}
-		defer conn.Close()
 		go s.Handle(conn)
 	}
 }
@@ -195,8 +415,14 @@ func (s *Server) checkType(handlerType reflect.Type) error {
 	if handlerType.Kind() != reflect.Func {
 		return errors.New("rpc.Register: handler is not func")
 	}
-	// parameter amount.
-	if handlerType.NumIn() != 1 {
+	// parameter amount, an optional context.Context may come first.
+	switch handlerType.NumIn() {
+	case 1:
+	case 2:
+		if handlerType.In(0) != contextType {
+			return errors.New("rpc.Register: first of two input parameters must be context.Context")
+		}
+	default:
 		return errors.New("rpc.Register: handler input parameters number is wrong, need one")
 	}
 	// response data amount.
@@ -204,13 +430,8 @@ func (s *Server) checkType(handlerType reflect.Type) error {
 		return errors.New("rpc.Register: handler output parameters number is wrong, need one")
 	}
 	// judge the parameter type and response data type.
-	if handlerType.In(0).Kind() != reflect.Struct || handlerType.Out(0).Kind() != reflect.Struct {
+	if handlerType.In(handlerType.NumIn()-1).Kind() != reflect.Struct || handlerType.Out(0).Kind() != reflect.Struct {
 		return errors.New("rpc.Register: parameters must be Struct")
 	}
 	return nil
 }
-
-//shutdown
-func (s *Server) Shutdown(listen *net.TCPListener) {
-	defer listen.Close()
-}
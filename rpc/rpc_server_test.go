@@ -0,0 +1,30 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPanicRecovered(t *testing.T) {
+	s := NewServer()
+	RegisterFunc(s, "Boom", func(ctx context.Context, r addReq) (addRes, error) {
+		var m map[string]int
+		m["x"] = 1
+		return addRes{}, nil
+	})
+	//the old handler asserts the wrong type
+	s.Register("Old", func(f interface{}) interface{} { return *f.(*addRes) }, func(r addReq) addRes { return addRes{} })
+	RegisterFunc(s, "Add", add)
+	c := newTestClient(t, serve(t, s))
+	var res addRes
+	for _, method := range []string{"Boom", "Old"} {
+		if err := c.Call(method, addReq{}, &res); !errors.Is(err, ErrInternal) {
+			t.Fatalf("%s: got %v, want internal error", method, err)
+		}
+	}
+	//the process and the connection carry on
+	if err := c.Call("Add", addReq{1, 1}, &res); err != nil || res.Sum != 2 {
+		t.Fatal(err)
+	}
+}
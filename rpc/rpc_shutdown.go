@@ -0,0 +1,131 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrServerClosed = errors.New("rpc_server: server closed")
+
+	//answer to requests which arrive after Shutdown started, another server may take them
+	errShuttingDown = &Error{Code: CodeUnavailable, Message: "server is shutting down", Retryable: true}
+)
+
+//stop the server gracefully: stop accepting, tell the clients to send no
+//more requests, wait for the requests being handled until ctx is done, then
+//close every connection. it returns how many requests were still running
+//when ctx was done, those are canceled. later calls wait for the same
+//requests with their own ctx.
+func (s *Server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	var conns []*serverConn
+	if !s.shutdown {
+		s.shutdown = true
+		for l := range s.listeners {
+			l.Close()
+		}
+		conns = make([]*serverConn, 0, len(s.conns))
+		for sc := range s.conns {
+			conns = append(conns, sc)
+		}
+		s.idle = make(chan struct{})
+		if s.active == 0 {
+			close(s.idle)
+		}
+	}
+	idle := s.idle
+	s.mu.Unlock()
+
+	for _, sc := range conns {
+		sc.goAway()
+	}
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	abandoned := s.active
+	for sc := range s.conns {
+		sc.cancel()
+		sc.conn.Close()
+	}
+	s.mu.Unlock()
+	return abandoned, err
+}
+
+//tell the client of the connection to send no more requests
+func (sc *serverConn) goAway() {
+	sc.wMu.Lock()
+	defer sc.wMu.Unlock()
+	if !sc.ready {
+		//old clients and unfinished handshakes can't be told, stop reading
+		sc.conn.SetReadDeadline(time.Now())
+		return
+	}
+	writeFrame(sc.conn, &frame{kind: kindGoAway})
+}
+
+//whether Shutdown has started
+func (s *Server) closing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shutdown
+}
+
+//count a request in, false once Shutdown has started
+func (s *Server) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return false
+	}
+	s.active++
+	return true
+}
+
+//count a request out
+func (s *Server) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	//no request starts after Shutdown, so this happens once
+	if s.active == 0 && s.shutdown {
+		close(s.idle)
+	}
+}
+
+//add or remove an open connection, adding fails once Shutdown has started
+func (s *Server) trackConn(sc *serverConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.conns, sc)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	s.conns[sc] = struct{}{}
+	return true
+}
+
+//add or remove a listener being served, adding fails once Shutdown has started
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.shutdown {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func slowServer() *Server {
+	s := NewServer()
+	RegisterFunc(s, "Slow", func(ctx context.Context, r addReq) (addRes, error) {
+		select {
+		case <-time.After(time.Duration(r.A) * time.Millisecond):
+		case <-ctx.Done():
+			return addRes{}, ctx.Err()
+		}
+		return addRes{r.A}, nil
+	})
+	return s
+}
+
+func TestShutdownDrains(t *testing.T) {
+	s := slowServer()
+	l, err := s.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+	c := newTestClient(t, l.Addr().String())
+	got := make(chan error, 1)
+	go func() { got <- c.Call("Slow", addReq{A: 200}, &addRes{}) }()
+	time.Sleep(50 * time.Millisecond)
+	if n, err := s.Shutdown(context.Background()); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+	//the call in flight was answered
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if err := c.Call("Slow", addReq{A: 1}, &addRes{}); err == nil {
+		t.Fatal("call after shutdown succeeded")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s := slowServer()
+	c := newTestClient(t, serve(t, s))
+	go c.Call("Slow", addReq{A: 5000}, &addRes{})
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if n, err := s.Shutdown(ctx); n != 1 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(n, err)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	s := slowServer()
+	c := newTestClient(t, serve(t, s))
+	go c.Call("Slow", addReq{A: 200}, &addRes{})
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := s.Shutdown(ctx)
+			done <- err
+		}()
+	}
+	//both callers see the drain, neither waits for its deadline
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Shutdown missed the drain")
+		}
+	}
+	if n, err := s.Shutdown(context.Background()); n != 0 || err != nil {
+		t.Fatal(n, err)
+	}
+}
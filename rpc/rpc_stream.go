@@ -0,0 +1,503 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//messages a side may send before the peer reads them and grants more
+const streamWindow = 16
+
+var errSendClosed = errors.New("rpc: send on a closed stream")
+
+//key of the ServerStream in the context of a stream handler
+type streamKey struct{}
+
+//register a stream handler. the client opens the stream with a Req, then
+//both sides send messages through the ServerStream until the handler
+//returns, the Res or error of fn ends the stream and goes back to the client.
+//interceptors of the server see the Req like the one of a normal call.
+func RegisterStream[Req, Res any](s *Server, name string, fn func(context.Context, Req, *ServerStream) (Res, error)) {
+	s.Se[name] = Handler{
+		intfc: func(ctx context.Context, req interface{}) (interface{}, error) {
+			return fn(ctx, *req.(*Req), ctx.Value(streamKey{}).(*ServerStream))
+		},
+		reqType: reflect.TypeOf((*Req)(nil)).Elem(),
+		resType: reflect.TypeOf((*Res)(nil)).Elem(),
+		stream:  true,
+	}
+}
+
+//messages of one stream in one direction, and the credit of the other one.
+//each side may send streamWindow messages ahead, the receiver grants more
+//as it reads them, so a slow reader holds back the sender instead of
+//filling the memory.
+type stream struct {
+	id       uint64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	codec    Codec
+	maxFrame uint32               //biggest frame body the peer accepts
+	write    func(f *frame) error //send a frame to the peer
+	recv     chan []byte          //messages of the peer not read yet
+
+	mu       sync.Mutex    //protect the fields below
+	credit   int           //messages this side may still send
+	granted  chan struct{} //closed when the peer grants more credit
+	read     int           //messages read since the last grant
+	sendDone bool          //this side sends no more messages
+	recvDone bool          //the peer sends no more messages
+	over     bool          //the server ended the whole stream
+	err      error         //why the stream broke off
+}
+
+func newStream(ctx context.Context, timeout time.Duration, id uint64, codec Codec, maxFrame uint32, write func(f *frame) error) *stream {
+	st := &stream{
+		id:       id,
+		codec:    codec,
+		maxFrame: maxFrame,
+		write:    write,
+		recv:     make(chan []byte, streamWindow),
+		credit:   streamWindow,
+		granted:  make(chan struct{}),
+	}
+	if timeout > 0 {
+		st.ctx, st.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		st.ctx, st.cancel = context.WithCancel(ctx)
+	}
+	return st
+}
+
+//context of the stream, done once the stream broke off or ended
+func (st *stream) Context() context.Context {
+	return st.ctx
+}
+
+//send one message, it waits while the peer has not read the ones before.
+//every message goes in one frame, so split big payloads into chunks.
+func (st *stream) Send(v interface{}) error {
+	data, err := st.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if uint32(len(data)) > st.maxFrame {
+		return ErrFrameTooBig
+	}
+	for {
+		st.mu.Lock()
+		if st.err != nil {
+			err = st.err
+			st.mu.Unlock()
+			return err
+		}
+		if st.over {
+			//the result is waiting for the caller
+			st.mu.Unlock()
+			return io.EOF
+		}
+		if st.sendDone {
+			st.mu.Unlock()
+			return errSendClosed
+		}
+		if st.ctx.Err() != nil {
+			st.mu.Unlock()
+			return st.ctxErr()
+		}
+		if st.credit > 0 {
+			st.credit--
+			st.mu.Unlock()
+			break
+		}
+		granted := st.granted
+		st.mu.Unlock()
+		//a peer which ended the stream cancels ctx too, look again which it was
+		select {
+		case <-granted:
+		case <-st.ctx.Done():
+		}
+	}
+	return st.write(&frame{kind: kindStreamData, id: st.id, body: data})
+}
+
+//read the next message of the peer into v, io.EOF once the peer sends no more
+func (st *stream) Recv(v interface{}) error {
+	data, err := st.next()
+	if err != nil {
+		return err
+	}
+	return st.codec.Unmarshal(data, v)
+}
+
+//take the next message and grant the peer credit for what was read
+func (st *stream) next() ([]byte, error) {
+	var data []byte
+	var ok bool
+	//messages already here go before the end of the context
+	select {
+	case data, ok = <-st.recv:
+	default:
+		select {
+		case data, ok = <-st.recv:
+		case <-st.ctx.Done():
+			//the end of the server closes recv right before ctx
+			select {
+			case data, ok = <-st.recv:
+			default:
+				return nil, st.ctxErr()
+			}
+		}
+	}
+	if !ok {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.err != nil {
+			return nil, st.err
+		}
+		return nil, io.EOF
+	}
+	st.mu.Lock()
+	st.read++
+	n := st.read
+	grant := n >= streamWindow/2 && !st.recvDone
+	if grant {
+		st.read = 0
+	}
+	st.mu.Unlock()
+	if grant {
+		var buf [binary.MaxVarintLen64]byte
+		st.write(&frame{kind: kindStreamWindow, id: st.id, body: buf[:binary.PutUvarint(buf[:], uint64(n))]})
+	}
+	return data, nil
+}
+
+//the error of a stream whose context is done, io.EOF when the server ended it
+func (st *stream) ctxErr() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.err != nil {
+		return st.err
+	}
+	if st.over {
+		return io.EOF
+	}
+	return st.ctx.Err()
+}
+
+//take a data or window frame of the peer
+func (st *stream) handle(f *frame) {
+	if f.kind == kindStreamWindow {
+		n, size := binary.Uvarint(f.body)
+		if size <= 0 {
+			st.fail(Errorf(CodeBadRequest, "bad stream window"))
+			return
+		}
+		st.mu.Lock()
+		st.credit += int(n)
+		close(st.granted)
+		st.granted = make(chan struct{})
+		st.mu.Unlock()
+		return
+	}
+	st.mu.Lock()
+	if st.recvDone {
+		st.mu.Unlock()
+		return
+	}
+	select {
+	case st.recv <- f.body:
+		st.mu.Unlock()
+	default:
+		st.mu.Unlock()
+		st.fail(Errorf(CodeBadRequest, "stream %d: peer sent more than its window", st.id))
+	}
+}
+
+//the peer sends no more messages
+func (st *stream) closeRecv() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.recvDone {
+		st.recvDone = true
+		close(st.recv)
+	}
+}
+
+//break off the stream with err, false if it already ended
+func (st *stream) fail(err error) bool {
+	st.mu.Lock()
+	if st.over || st.err != nil {
+		st.mu.Unlock()
+		return false
+	}
+	st.err = err
+	if !st.recvDone {
+		st.recvDone = true
+		close(st.recv)
+	}
+	st.mu.Unlock()
+	st.cancel()
+	return true
+}
+
+//server side of a stream, handed to the handler registered by RegisterStream
+type ServerStream struct {
+	*stream
+}
+
+//a client opened a stream, run its handler in a goroutine
+func (sc *serverConn) openStream(ctx context.Context, f *frame) {
+	req, err := decodeRequest(f.body)
+	if err != nil {
+		sc.endStream(f.id, nil, Errorf(CodeBadRequest, "bad stream request: %v", err))
+		return
+	}
+	//counted like a request, so Shutdown waits for it
+	if !sc.s.begin() {
+		sc.endStream(f.id, nil, errShuttingDown)
+		return
+	}
+	atomic.AddInt32(&sc.busy, 1)
+	ss := &ServerStream{newStream(ctx, time.Duration(req.Timeout), f.id, sc.codec, sc.peerMaxFrame, sc.write)}
+	sc.sMu.Lock()
+	if sc.streams == nil {
+		sc.streams = make(map[uint64]*ServerStream)
+	}
+	sc.streams[f.id] = ss
+	sc.sMu.Unlock()
+	go sc.serveStream(ss, req)
+}
+
+//run the handler of the stream and end it with the result
+func (sc *serverConn) serveStream(ss *ServerStream, req Request) {
+	defer sc.s.end()
+	defer sc.done()
+	defer func() {
+		sc.sMu.Lock()
+		delete(sc.streams, ss.id)
+		sc.sMu.Unlock()
+		ss.cancel()
+	}()
+	resp, err := sc.s.find(context.WithValue(ss.ctx, streamKey{}, ss), sc.codec, req)
+	var data []byte
+	if err == nil {
+		data, err = sc.codec.Marshal(resp)
+		if err != nil {
+			err = Errorf(CodeInternal, "encode response: %v", err)
+		} else if uint32(len(data)) > sc.peerMaxFrame {
+			err = Errorf(CodeInternal, "response of %d bytes is bigger than the client accepts", len(data))
+		}
+	}
+	//the client canceled the stream or went away
+	if ss.ctx.Err() != nil {
+		//a client which broke the protocol learns why
+		if e, ok := ss.ctxErr().(*Error); ok {
+			sc.endStream(ss.id, nil, e)
+		}
+		return
+	}
+	sc.endStream(ss.id, data, err)
+}
+
+//end the stream with the response or the error
+func (sc *serverConn) endStream(id uint64, data []byte, err error) error {
+	if err != nil {
+		return sc.write(&frame{kind: kindStreamEnd, flags: flagError, id: id, body: encodeError(toError(err))})
+	}
+	return sc.write(&frame{kind: kindStreamEnd, id: id, body: data})
+}
+
+//hand a frame of the client to its stream
+func (sc *serverConn) streamFrame(f *frame) {
+	sc.sMu.Lock()
+	ss := sc.streams[f.id]
+	sc.sMu.Unlock()
+	if ss == nil {
+		//the stream has already ended
+		return
+	}
+	if f.kind != kindStreamEnd {
+		ss.handle(f)
+		return
+	}
+	if f.flags&flagError != 0 {
+		//the client gave up
+		ss.fail(context.Canceled)
+		return
+	}
+	ss.closeRecv()
+}
+
+//client side of a stream. the stream holds a connection of the pool until
+//the server ends it or its context is done.
+type ClientStream struct {
+	*stream
+	final *frame //end frame of the server, guarded by mu
+}
+
+//open a stream of the stream handler name with the first request req.
+//streams skip the retries and the client interceptors, a stream which
+//broke off can't be replayed.
+func (c *Client) NewStream(ctx context.Context, name string, req interface{}) (*ClientStream, error) {
+	ep, err := c.pick(name, req)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := ep.getConn(ctx)
+	if err != nil {
+		ep.report(err)
+		return nil, err
+	}
+	cs, err := cc.openStream(ctx, name, req)
+	if err != nil {
+		ep.release(cc)
+		ep.report(err)
+		return nil, err
+	}
+	go func() {
+		<-cs.ctx.Done()
+		//the caller gave up before the server ended the stream
+		if cs.fail(cs.ctx.Err()) {
+			cs.write(&frame{kind: kindStreamEnd, flags: flagError, id: cs.id})
+		}
+		cc.forgetStream(cs.id)
+		ep.release(cc)
+	}()
+	return cs, nil
+}
+
+//send the request which opens the stream
+func (cc *clientConn) openStream(ctx context.Context, name string, req interface{}) (*ClientStream, error) {
+	data, err := cc.codec.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r := Request{ReqName: name, ReqData: data}
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		r.Timeout = int64(time.Until(deadline))
+		if r.Timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	body := encodeRequest(r)
+	if uint32(len(body)) > cc.peerMaxFrame {
+		return nil, ErrFrameTooBig
+	}
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, &ConnError{Err: cc.err}
+	}
+	if cc.draining {
+		cc.mu.Unlock()
+		return nil, &ConnError{Err: errGoAway}
+	}
+	cc.seq++
+	id := cc.seq
+	cs := &ClientStream{stream: newStream(ctx, 0, id, cc.codec, cc.peerMaxFrame, func(f *frame) error {
+		if err := cc.write(f, deadline); err != nil {
+			return &ConnError{Err: err, Sent: true}
+		}
+		return nil
+	})}
+	cc.streams[id] = cs
+	cc.mu.Unlock()
+
+	if err := cc.write(&frame{kind: kindStreamOpen, id: id, body: body}, deadline); err != nil {
+		cc.forgetStream(id)
+		cs.cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &ConnError{Err: err}
+	}
+	return cs, nil
+}
+
+//stop routing the frames of stream id
+func (cc *clientConn) forgetStream(id uint64) {
+	cc.mu.Lock()
+	delete(cc.streams, id)
+	cc.mu.Unlock()
+}
+
+//hand a frame of the server to its stream
+func (cc *clientConn) streamFrame(f *frame) {
+	cc.mu.Lock()
+	cs := cc.streams[f.id]
+	if f.kind == kindStreamEnd {
+		delete(cc.streams, f.id)
+	}
+	cc.mu.Unlock()
+	if cs == nil {
+		return
+	}
+	if f.kind != kindStreamEnd {
+		cs.handle(f)
+		return
+	}
+	cs.mu.Lock()
+	if cs.err == nil {
+		cs.over = true
+		cs.final = f
+	}
+	cs.mu.Unlock()
+	cs.closeRecv()
+	//frees the connection
+	cs.cancel()
+}
+
+//tell the server no more messages come, Recv still gets its messages
+func (cs *ClientStream) CloseSend() error {
+	cs.mu.Lock()
+	if cs.sendDone || cs.over || cs.err != nil {
+		cs.mu.Unlock()
+		return nil
+	}
+	cs.sendDone = true
+	cs.mu.Unlock()
+	return cs.write(&frame{kind: kindStreamEnd, id: cs.id})
+}
+
+//wait for the server to end the stream and decode its response into res.
+//messages of the server not read by Recv are dropped.
+func (cs *ClientStream) Result(res interface{}) error {
+	for {
+		_, err := cs.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cs.mu.Lock()
+	f := cs.final
+	cs.mu.Unlock()
+	if f.flags&flagError != 0 {
+		return decodeError(f.body)
+	}
+	if res == nil {
+		return nil
+	}
+	if err := cs.codec.Unmarshal(f.body, res); err != nil {
+		return fmt.Errorf("rpc_client: decode stream response: %v", err)
+	}
+	return nil
+}
+
+//close the sending side and wait for the response, for client streams
+func (cs *ClientStream) CloseAndRecv(res interface{}) error {
+	if err := cs.CloseSend(); err != nil {
+		return err
+	}
+	return cs.Result(res)
+}
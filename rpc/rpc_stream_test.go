@@ -0,0 +1,146 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type chunk struct{ B []byte }
+
+//"Up" adds up the bytes sent, "Down" sends A numbers, then -1 as the result.
+//"Refuse" reads nothing and fails after A ms.
+func streamServer(s *Server) {
+	RegisterStream(s, "Up", func(ctx context.Context, r addReq, st *ServerStream) (addRes, error) {
+		n := 0
+		for {
+			var c chunk
+			err := st.Recv(&c)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return addRes{}, err
+			}
+			n += len(c.B)
+		}
+		return addRes{n}, nil
+	})
+	RegisterStream(s, "Down", func(ctx context.Context, r addReq, st *ServerStream) (addRes, error) {
+		for i := 0; i < r.A; i++ {
+			if err := st.Send(addRes{i}); err != nil {
+				return addRes{}, err
+			}
+		}
+		return addRes{-1}, nil
+	})
+	RegisterStream(s, "Refuse", func(ctx context.Context, r addReq, st *ServerStream) (addRes, error) {
+		time.Sleep(time.Duration(r.A) * time.Millisecond)
+		return addRes{}, Errorf(CodeBadRequest, "refused")
+	})
+	RegisterFunc(s, "Add", add)
+}
+
+func TestStreamUpload(t *testing.T) {
+	_, c := memoryPair(t, streamServer, WithMaxFrameSize(1<<10))
+	cs, err := c.NewStream(context.Background(), "Up", addReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//far more chunks than the window, the sender waits for credit
+	for i := 0; i < 100; i++ {
+		if err := cs.Send(chunk{make([]byte, 500)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var res addRes
+	if err := cs.CloseAndRecv(&res); err != nil || res.Sum != 50000 {
+		t.Fatal(err, res)
+	}
+	if err := cs.Send(chunk{make([]byte, 2000)}); err != ErrFrameTooBig {
+		t.Fatalf("got %v, want frame too big", err)
+	}
+}
+
+func TestStreamServerEndsEarly(t *testing.T) {
+	_, c := memoryPair(t, streamServer)
+	for i := 0; i < 20; i++ {
+		cs, err := c.NewStream(context.Background(), "Refuse", addReq{A: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the window fills up and Send waits for credit when the server ends
+		for {
+			err = cs.Send(chunk{make([]byte, 500)})
+			if err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			t.Fatalf("run %d: Send returned %v, want io.EOF", i, err)
+		}
+		if err := cs.Result(&addRes{}); !errors.Is(err, ErrBadRequest) {
+			t.Fatalf("run %d: got %v, want the error of the server", i, err)
+		}
+	}
+}
+
+func TestStreamDownload(t *testing.T) {
+	_, c := memoryPair(t, streamServer)
+	ctx := context.Background()
+	cs, err := c.NewStream(ctx, "Down", addReq{A: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res addRes
+	for i := 0; i < 100; i++ {
+		if err := cs.Recv(&res); err != nil || res.Sum != i {
+			t.Fatal(err, res, i)
+		}
+	}
+	if err := cs.Recv(&res); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+	if err := cs.Result(&res); err != nil || res.Sum != -1 {
+		t.Fatal(err, res)
+	}
+	//messages not read are dropped by Result
+	cs, _ = c.NewStream(ctx, "Down", addReq{A: 100})
+	if err := cs.Result(&res); err != nil || res.Sum != -1 {
+		t.Fatal(err, res)
+	}
+}
+
+func TestStreamCanceled(t *testing.T) {
+	_, c := memoryPair(t, streamServer)
+	ctx, cancel := context.WithCancel(context.Background())
+	cs, err := c.NewStream(ctx, "Up", addReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Send(chunk{[]byte("a")})
+	cancel()
+	if err := cs.Send(chunk{[]byte("a")}); err != context.Canceled {
+		t.Fatalf("got %v, want canceled", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st := c.Stats(); st.InUse != 0 {
+		t.Fatalf("canceled stream holds a connection: %+v", st)
+	}
+}
+
+func TestStreamKindMismatch(t *testing.T) {
+	_, c := memoryPair(t, streamServer)
+	if err := c.Call("Up", addReq{}, &addRes{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("unary call of a stream: %v", err)
+	}
+	cs, err := c.NewStream(context.Background(), "Add", addReq{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Result(&addRes{}); !errors.Is(err, ErrBadRequest) {
+		t.Fatalf("stream of a unary method: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"GoUserManaSys/log"
+)
+
+//encrypt the connections with TLS. a server uses it on every accepted
+//connection, a client on every dial. build it with ServerTLSConfig and
+//ClientTLSConfig to reload the certificates when their files change.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+//certificate and key loaded from files, loaded again on the next
+//handshake after either file changed, so a renewed certificate is used
+//without a restart
+type CertReloader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex //protect the fields below
+	cert    *tls.Certificate
+	modTime time.Time //newest modification time of the files when loaded
+}
+
+//load the certificate and key, fails when they can't be used
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//the certificate, loaded again when the files changed. a broken new pair
+//is logged and the old certificate stays in use.
+func (r *CertReloader) load() (*tls.Certificate, error) {
+	modTime, err := newestModTime(r.certFile, r.keyFile)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err == nil {
+			r.cert, r.modTime = &cert, modTime
+			return r.cert, nil
+		}
+	}
+	if r.cert == nil {
+		return nil, fmt.Errorf("rpc_tls: load %s: %v", r.certFile, err)
+	}
+	log.ErrorLog("rpc_tls: reload %s failed, keep the old certificate. err:%s", r.certFile, err)
+	return r.cert, nil
+}
+
+//for tls.Config.GetCertificate of a server
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+//for tls.Config.GetClientCertificate of a client
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.load()
+}
+
+//later modification time of the files
+func newestModTime(files ...string) (time.Time, error) {
+	var newest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+//pool of the PEM certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("rpc_tls: no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+//TLS config of a server with the certificate in certFile and keyFile.
+//when clientCAFile is set the clients must show a certificate it signed.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{GetCertificate: r.GetCertificate, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+//TLS config of a client which trusts the servers signed by caFile, or by
+//the system roots when it is empty. certFile and keyFile are the client
+//certificate for servers which verify clients, they may be empty.
+//serverName is checked against the server certificate, the host of the
+//address is used when it is empty.
+func ClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		r, err := NewCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+//run the TLS handshake of conn in time
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("rpc_tls: handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+	return nil
+}
+
+//wrap a dialed connection in TLS within ctx, host is the server name to
+//verify when the config names none
+func clientTLS(ctx context.Context, conn net.Conn, cfg *tls.Config, host string) (net.Conn, error) {
+	if cfg.ServerName == "" {
+		if host == "" {
+			return nil, errors.New("rpc_tls: no server name to verify")
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("rpc_tls: handshake with %s: %w", conn.RemoteAddr(), err)
+	}
+	return tc, nil
+}
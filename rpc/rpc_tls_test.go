@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//test certificates written to a temp dir as name.pem and name.key
+type testPKI struct {
+	t     *testing.T
+	dir   string
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+//new CA in a temp dir, written as ca.pem
+func newTestPKI(t *testing.T) *testPKI {
+	p := &testPKI{t: t, dir: t.TempDir()}
+	p.ca, p.caKey = p.issue("ca", 1)
+	return p
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+//issue a certificate for localhost signed by the CA, self signed for the CA itself
+func (p *testPKI) issue(name string, serial int64) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  p.ca == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := tpl, key
+	if p.ca != nil {
+		parent, signer = p.ca, p.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(p.path(name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := os.WriteFile(p.path(name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		p.t.Fatal(err)
+	}
+	return cert, key
+}
+
+//server requiring client certificates signed by the CA
+func tlsServer(t *testing.T, p *testPKI) string {
+	p.issue("server", 2)
+	cfg, err := ServerTLSConfig(p.path("server.pem"), p.path("server.key"), p.path("ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(WithTLS(cfg))
+	RegisterFunc(s, "Add", add)
+	return serve(t, s)
+}
+
+func TestMutualTLS(t *testing.T) {
+	p := newTestPKI(t)
+	addr := tlsServer(t, p)
+	p.issue("client", 3)
+	cfg, err := ClientTLSConfig(p.path("ca.pem"), p.path("client.pem"), p.path("client.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res addRes
+	if err := newTestClient(t, addr, WithTLS(cfg)).Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err)
+	}
+	//a client without a certificate is refused
+	nocert, err := ClientTLSConfig(p.path("ca.pem"), "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestClient(t, addr, WithTLS(nocert)).Call("Add", addReq{1, 2}, &res); err == nil {
+		t.Fatal("client without a certificate accepted")
+	}
+	//so is a plain one
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := newTestClient(t, addr).CallContext(ctx, "Add", addReq{1, 2}, &res); err == nil {
+		t.Fatal("plain client accepted")
+	}
+}
+
+func TestTLSUntrustedServer(t *testing.T) {
+	addr := tlsServer(t, newTestPKI(t))
+	//the client trusts another CA
+	other := newTestPKI(t)
+	other.issue("client", 3)
+	cfg, err := ClientTLSConfig(other.path("ca.pem"), other.path("client.pem"), other.path("client.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestClient(t, addr, WithTLS(cfg)).Call("Add", addReq{1, 2}, &addRes{}); err == nil {
+		t.Fatal("server of an unknown CA trusted")
+	}
+}
+
+func TestCertReloaderRotation(t *testing.T) {
+	p := newTestPKI(t)
+	addr := tlsServer(t, p)
+	p.issue("client", 3)
+	cfg, err := ClientTLSConfig(p.path("ca.pem"), p.path("client.pem"), p.path("client.key"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		c := newTestClient(t, addr, WithTLS(cfg), WithPool(PoolConfig{MinConns: 1}))
+		st := c.endpoints[0].conns[0].conn.(*tls.Conn).ConnectionState()
+		return st.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 2 {
+		t.Fatalf("server shows serial %d, want 2", got)
+	}
+	//renew the server certificate, new connections get it without a restart
+	p.issue("server", 99)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(p.path("server.pem"), later, later)
+	if got := serial(); got != 99 {
+		t.Fatalf("server shows serial %d after the renewal, want 99", got)
+	}
+	//a broken renewal keeps the old certificate in use
+	os.WriteFile(p.path("server.pem"), []byte("garbage"), 0600)
+	later = later.Add(time.Second)
+	os.Chtimes(p.path("server.pem"), later, later)
+	if got := serial(); got != 99 {
+		t.Fatalf("server shows serial %d after a broken renewal, want 99", got)
+	}
+}
+
+func TestCertReloaderBadFiles(t *testing.T) {
+	p := newTestPKI(t)
+	if _, err := NewCertReloader(p.path("ca.pem"), p.path("missing.key")); err == nil {
+		t.Fatal("missing key accepted")
+	}
+}
@@ -0,0 +1,158 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//how connections between client and server are made
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(ctx context.Context, address string) (net.Conn, error)
+}
+
+//set the transport of the server or client, TCP by default
+func WithTransport(t Transport) Option {
+	return func(o *options) {
+		o.transport = t
+	}
+}
+
+//transport by network name: tcp or unix
+func NetworkTransport(network string) (Transport, error) {
+	switch network {
+	case "", "tcp", "tcp4":
+		return TCP(), nil
+	case "unix":
+		return Unix(), nil
+	}
+	return nil, fmt.Errorf("rpc: unknown network %q", network)
+}
+
+type tcpTransport struct{}
+
+//tcp over ipv4, addresses are host:port
+func TCP() Transport {
+	return tcpTransport{}
+}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp4", address)
+}
+
+func (tcpTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp4", address)
+}
+
+type unixTransport struct{}
+
+//unix domain sockets for client and server on the same machine,
+//addresses are socket file paths
+func Unix() Transport {
+	return unixTransport{}
+}
+
+func (unixTransport) Listen(address string) (net.Listener, error) {
+	//a socket file left by a crashed server blocks the listen. one a live
+	//server answers on is kept, then the listen fails.
+	if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(address)
+		}
+	}
+	return net.Listen("unix", address)
+}
+
+func (unixTransport) Dial(ctx context.Context, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", address)
+}
+
+var errNoListener = errors.New("rpc: no memory listener")
+
+//transport inside the process made of net.Pipe, no port or file is used.
+//servers and clients must share the same Memory value, addresses are any names.
+type Memory struct {
+	mu        sync.Mutex //protect listeners
+	listeners map[string]*memListener
+}
+
+//new memory transport with its own names
+func NewMemory() *Memory {
+	return &Memory{listeners: make(map[string]*memListener)}
+}
+
+func (m *Memory) Listen(address string) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[address]; ok {
+		return nil, fmt.Errorf("rpc: memory address %q in use", address)
+	}
+	l := &memListener{m: m, addr: memAddr(address), conns: make(chan net.Conn), done: make(chan struct{})}
+	m.listeners[address] = l
+	return l, nil
+}
+
+func (m *Memory) Dial(ctx context.Context, address string) (net.Conn, error) {
+	m.mu.Lock()
+	l, ok := m.listeners[address]
+	m.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errNoListener, address)
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("%w %q", errNoListener, address)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//listener of the memory transport, Dial hands it the server end of a pipe
+type memListener struct {
+	m     *Memory
+	addr  memAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.m.mu.Lock()
+		delete(l.m.listeners, string(l.addr))
+		l.m.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+//address of the memory transport
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//server and client of it on a memory transport of their own
+func memoryPair(t *testing.T, register func(*Server), opts ...Option) (*Server, *Client) {
+	t.Helper()
+	m := NewMemory()
+	s := NewServer(append(opts, WithTransport(m))...)
+	register(s)
+	addr := serve(t, s)
+	return s, newTestClient(t, addr, append(opts, WithTransport(m))...)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	_, c := memoryPair(t, func(s *Server) { RegisterFunc(s, "Add", add) }, WithHeartbeat(1e9, 0))
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var res addRes
+			if err := c.Call("Add", addReq{i, 2}, &res); err != nil || res.Sum != i+2 {
+				t.Errorf("call %d: sum %d, err %v", i, res.Sum, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemoryAddresses(t *testing.T) {
+	m := NewMemory()
+	l, err := m.Listen("tcpserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Listen("tcpserver"); err == nil {
+		t.Fatal("memory address taken twice")
+	}
+	//names are per Memory
+	if l2, err := NewMemory().Listen("tcpserver"); err != nil {
+		t.Fatal(err)
+	} else {
+		l2.Close()
+	}
+	l.Close()
+	if _, err := m.Dial(context.Background(), "tcpserver"); !errors.Is(err, errNoListener) {
+		t.Fatalf("dial a closed listener: %v", err)
+	}
+	c := newTestClient(t, "nobody", WithTransport(m))
+	if err := c.Call("Add", addReq{}, &addRes{}); err == nil {
+		t.Fatal("call without a server succeeded")
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	s := NewServer(WithTransport(Unix()))
+	RegisterFunc(s, "Add", add)
+	l, err := s.Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+	var res addRes
+	if err := newTestClient(t, path, WithTransport(Unix())).Call("Add", addReq{1, 2}, &res); err != nil || res.Sum != 3 {
+		t.Fatal(err)
+	}
+	//a second server doesn't take the socket of a live one
+	if l2, err := Unix().Listen(path); err == nil {
+		l2.Close()
+		t.Fatal("socket of a live server taken")
+	}
+	if err := newTestClient(t, path, WithTransport(Unix())).Call("Add", addReq{1, 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	//a socket file nobody listens on, like one left by a crash
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Unix().Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
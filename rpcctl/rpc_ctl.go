@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"GoUserManaSys/rpc"
+	"GoUserManaSys/utils"
+)
+
+const usage = `rpcctl, look into and call a tcpserver from the terminal
+
+usage:
+  rpcctl [flags] list                    list the methods with their request and response fields
+  rpcctl [flags] call <method> [json]    call method with the json request, read from stdin when missing or -
+
+flags:
+`
+
+func main() {
+	addr := flag.String("addr", utils.RpcEndpoints[0], "address of the tcpserver")
+	network := flag.String("network", utils.RpcNetwork, "rpc network, tcp or unix")
+	timeout := flag.Duration("timeout", utils.CallTimeout, "how long a call may take")
+	asJSON := flag.Bool("json", false, "print the method list as json")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c, err := newClient(*addr, *network)
+	if err != nil {
+		fail(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	switch args[0] {
+	case "list":
+		err = list(ctx, c, *asJSON)
+	case "call":
+		err = call(ctx, c, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+//client of one tcpserver speaking json, so requests typed in the terminal go
+//through as they are. TLS and auth come from the config like for httpserver.
+func newClient(addr string, network string) (*rpc.Client, error) {
+	tr, err := rpc.NetworkTransport(network)
+	if err != nil {
+		return nil, err
+	}
+	opts := []rpc.Option{rpc.WithTransport(tr), rpc.WithMaxFrameSize(utils.MaxFrameSize), rpc.WithCodecs(rpc.JSONCodec{}.Name())}
+	if len(utils.RpcCompression) > 0 {
+		opts = append(opts, rpc.WithCompression(utils.RpcCompressSize, utils.RpcCompression...))
+	}
+	if utils.TLSEnable {
+		cfg, err := rpc.ClientTLSConfig(utils.TLSCAFile, utils.TLSClientCertFile, utils.TLSClientKeyFile, utils.TLSServerName)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, rpc.WithTLS(cfg))
+	}
+	if utils.AuthKeys != "" {
+		k, err := rpc.ParseKeyring(utils.AuthKeys, utils.AuthKeyID)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, rpc.WithAuth(k))
+	}
+	return rpc.NewClient(1, addr, opts...)
+}
+
+//print the methods of the server
+func list(ctx context.Context, c *rpc.Client, asJSON bool) error {
+	methods, err := c.Methods(ctx)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		b, err := json.MarshalIndent(methods, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+	for _, m := range methods {
+		if m.Stream {
+			fmt.Println(m.Name, "(stream, rpcctl can't call it)")
+		} else {
+			fmt.Println(m.Name)
+		}
+		fmt.Println("  request ", describe(m.Request))
+		fmt.Println("  response", describe(m.Response))
+	}
+	return nil
+}
+
+//one line of the schema, like utils.ReqLogin {username string, password string}
+func describe(sc *rpc.Schema) string {
+	if len(sc.Fields) == 0 {
+		return sc.Type
+	}
+	fields := make([]string, 0, len(sc.Fields))
+	for _, f := range sc.Fields {
+		fields = append(fields, f.Name+" "+describe(f))
+	}
+	return sc.Type + " {" + strings.Join(fields, ", ") + "}"
+}
+
+//call the method with the json request and print the json response
+func call(ctx context.Context, c *rpc.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("call needs the method name")
+	}
+	var req []byte
+	if len(args) < 2 || args[1] == "-" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req = bytes.TrimSpace(b)
+	} else {
+		req = []byte(args[1])
+	}
+	if len(req) == 0 {
+		req = []byte("{}")
+	}
+	if !json.Valid(req) {
+		return fmt.Errorf("request of %s is not valid json", args[0])
+	}
+	var res json.RawMessage
+	if err := c.CallContext(ctx, args[0], json.RawMessage(req), &res); err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, res, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "rpcctl:", err)
+	os.Exit(1)
+}
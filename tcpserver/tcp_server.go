@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	"GoUserManaSys/dao"
 	"GoUserManaSys/log"
@@ -12,70 +16,129 @@ import (
 	"GoUserManaSys/utils"
 )
 
+//rpc server, services publish user events through it
+var _server *rpc.Server
+
 func main() {
 	//init log.
 	if err := log.ConfigLog(utils.TCPServerLogPath, log.LevelInfo); err != nil {
 		panic(err)
 	}
 	//init rpc server
-	s := rpc.NewServer()
+	tr, err := rpc.NetworkTransport(utils.RpcNetwork)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	opts := []rpc.Option{rpc.WithTransport(tr), rpc.WithMaxFrameSize(utils.MaxFrameSize), rpc.WithIdleTimeout(utils.IdleTimeout), rpc.WithBatchWorkers(utils.BatchWorkers)}
+	if len(utils.RpcCompression) > 0 {
+		//big bodies like pictures go out compressed to clients which ask for it
+		opts = append(opts, rpc.WithCompression(utils.RpcCompressSize, utils.RpcCompression...))
+	}
+	if utils.TLSEnable {
+		//clients must show a certificate signed by TLSClientCAFile when it is set
+		cfg, err := rpc.ServerTLSConfig(utils.TLSCertFile, utils.TLSKeyFile, utils.TLSClientCAFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts = append(opts, rpc.WithTLS(cfg))
+	}
+	if utils.AuthKeys != "" {
+		//only httpservers holding one of the keys may call the services
+		k, err := rpc.ParseKeyring(utils.AuthKeys, "")
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts = append(opts, rpc.WithAuth(k))
+	}
+	if len(utils.RpcLimits) > 0 {
+		//calls over the limits are refused before they reach mysql
+		limits := make(map[string]rpc.Limit, len(utils.RpcLimits))
+		for name, v := range utils.RpcLimits {
+			if limits[name], err = rpc.ParseLimit(v); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		opts = append(opts, rpc.WithLimits(limits))
+	}
+	s := rpc.NewServer(opts...)
+	_server = s
+	//common steps of every service
+	s.Use(logInterceptor, authInterceptor)
 	//register server
-	s.Register("AddUser", AddUser, AddUserServ)
-	s.Register("Login", Login, LoginServ)
-	s.Register("GetInfo", GetInfo, GetInfoServ)
-	s.Register("UpdateNickName", UpdateNickName, UpdateNickNameServ)
-	s.Register("UploadPic", UploadPic, UploadPicServ)
-	s.Register("Logout", Logout, LogoutServ)
+	rpc.RegisterFunc(s, "AddUser", AddUserServ)
+	rpc.RegisterFunc(s, "Login", LoginServ)
+	rpc.RegisterFunc(s, "GetInfo", GetInfoServ)
+	rpc.RegisterFunc(s, "UpdateNickName", UpdateNickNameServ)
+	rpc.RegisterFunc(s, "UploadPic", UploadPicServ)
+	rpc.RegisterStream(s, "UploadPicStream", UploadPicStreamServ)
+	rpc.RegisterFunc(s, "Logout", LogoutServ)
 	//listen
 	l, err := s.Listen(utils.ServerPort)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	done := make(chan struct{})
 	go func() {
-		quit := make(chan os.Signal)
+		defer close(done)
+		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 		<-quit
 		fmt.Println("handling shutdown")
-		s.Shutdown(l)
+		//let the running calls finish, clients send new ones elsewhere
+		ctx, cancel := context.WithTimeout(context.Background(), utils.ShutdownWait)
+		defer cancel()
+		if n, err := s.Shutdown(ctx); err != nil {
+			log.ErrorLog("tcp_server: shutdown timed out, %d calls abandoned", n)
+		}
 		dao.CloseRedis()
 		fmt.Println("shutdown successfully")
 	}()
-	if err != nil {
+	//serve
+	if err = s.Serve(l); err != rpc.ErrServerClosed {
 		fmt.Println(err)
+		return
 	}
-	//serve
-	s.Serve(l)
-}
-
-//add user interface
-func AddUser(f interface{}) interface{} {
-	return AddUserServ(*f.(*utils.ReqAdd))
-}
-
-// Login interface.
-func Login(f interface{}) interface{} {
-	return LoginServ(*f.(*utils.ReqLogin))
-}
-
-//logout interface
-func Logout(f interface{}) interface{} {
-	return LogoutServ(*f.(*utils.ReqLogout))
+	<-done
 }
 
-//GetInfo
-func GetInfo(f interface{}) interface{} {
-	return GetInfoServ(*f.(*utils.ReqGetInfo))
-}
-
-//update profile picture interface
-func UploadPic(f interface{}) interface{} {
-	return UploadPicServ(*f.(*utils.ReqUploadPic))
+//log every call, failed calls at error level
+func logInterceptor(ctx context.Context, info *rpc.CallInfo, req interface{}, next rpc.HandlerFunc) (interface{}, error) {
+	start := time.Now()
+	res, err := next(ctx, req)
+	if err != nil {
+		log.ErrorLog("tcp_server_%s: call failed. err:%s", info.Method, err)
+		return res, err
+	}
+	log.DebugLog("tcp_server_%s: call done in %s", info.Method, time.Since(start))
+	return res, nil
 }
 
-//update nicknam interface
-func UpdateNickName(f interface{}) interface{} {
-	return UpdateNickNameServ(*f.(*utils.ReqUpdNickName))
+//check the token of requests which carry one, the services only run for logged in users
+func authInterceptor(ctx context.Context, info *rpc.CallInfo, req interface{}, next rpc.HandlerFunc) (interface{}, error) {
+	r, ok := req.(utils.TokenReq)
+	if !ok {
+		return next(ctx, req)
+	}
+	code := dao.CheckToken(r.GetUserName(), r.GetToken())
+	if code == utils.Success {
+		return next(ctx, req)
+	}
+	//token don't match, answer with the code and skip the service
+	log.ErrorLog("tcp_server_%s: check token failed. username:%s, code:%d", info.Method, r.GetUserName(), code)
+	res := reflect.New(info.ResType).Interface()
+	if c, ok := res.(utils.CodeRes); ok {
+		c.SetCode(code)
+	}
+	return res, nil
 }
 
 //login service
-func LoginServ(req utils.ReqLogin) (res utils.ResLogin) {
+func LoginServ(ctx context.Context, req utils.ReqLogin) (res utils.ResLogin, err error) {
 
 	code := dao.Login(req.UserName, req.PassWord)
 	res.Code = code
@@ -108,7 +171,7 @@ func LoginServ(req utils.ReqLogin) (res utils.ResLogin) {
 }
 
 //add user service
-func AddUserServ(req utils.ReqAdd) (res utils.ResAdd) {
+func AddUserServ(ctx context.Context, req utils.ReqAdd) (res utils.ResAdd, err error) {
 	//username or password can't be nil
 	if req.UserName == "" || req.PassWord == "" {
 		res.Code = utils.ErrNil
@@ -126,15 +189,8 @@ func AddUserServ(req utils.ReqAdd) (res utils.ResAdd) {
 }
 
 //get info service
-func GetInfoServ(req utils.ReqGetInfo) (res utils.ResGetInfo) {
-	//if token don't match ,return
-	code := dao.CheckToken(req.UserName, req.Token)
-	if code != utils.Success {
-		log.ErrorLog("tcp_server_getInfo: getInfo failed. username:%s, code:%d", req.UserName, code)
-		res.Code = code
-		return
-	}
-	//token right, get data from redis first
+func GetInfoServ(ctx context.Context, req utils.ReqGetInfo) (res utils.ResGetInfo, err error) {
+	//token is checked by authInterceptor, get data from redis first
 	nickname, profilepicture, hasData, errCode := dao.RdsGetInfo(req.UserName)
 	//err
 	if errCode == utils.ErrRedisGet {
@@ -156,7 +212,7 @@ func GetInfoServ(req utils.ReqGetInfo) (res utils.ResGetInfo) {
 	//redis no data, get data from db
 	nickname, profilepicture, errCode = dao.GetInfo(req.UserName)
 	if errCode != utils.Success {
-		res.Code = code
+		res.Code = errCode
 		log.ErrorLog("tcp_server_getInfo: getInfo from db failed. username:%s", req.UserName)
 		return
 	}
@@ -173,13 +229,7 @@ func GetInfoServ(req utils.ReqGetInfo) (res utils.ResGetInfo) {
 }
 
 //update nickname service
-func UpdateNickNameServ(req utils.ReqUpdNickName) (res utils.ResUpdNickName) {
-	code := dao.CheckToken(req.UserName, req.Token)
-	if code != utils.Success {
-		res.Code = code
-		log.ErrorLog("tcp_server_updateNickname: update failed. username:%s,code:%d", req.UserName, code)
-		return
-	}
+func UpdateNickNameServ(ctx context.Context, req utils.ReqUpdNickName) (res utils.ResUpdNickName, err error) {
 	//token success, invalid redis data
 	//code = dao.Invalid(req.UserName)
 	//if code != utils.Success {
@@ -189,23 +239,20 @@ func UpdateNickNameServ(req utils.ReqUpdNickName) (res utils.ResUpdNickName) {
 	//}
 	dao.RdsDelInfo(req.UserName)
 	//update db
-	code = dao.UpdateNickName(req.UserName, req.NickName)
+	code := dao.UpdateNickName(req.UserName, req.NickName)
 	res.Code = code
+	if code == utils.Success {
+		publishUser(req.UserName, utils.EventNickName)
+	}
 	//fmt.Println("tcp_server_updateNickname: update success. username:%s", req.UserName)
 	//log.InfoLog("tcp_server_updateNickname: update success. username:%s", req.UserName)
 	return
 }
 
 //upload profile picture
-func UploadPicServ(req utils.ReqUploadPic) (res utils.ResUploadPic) {
-	code := dao.CheckToken(req.UserName, req.Token)
-	if code != utils.Success {
-		res.Code = code
-		log.ErrorLog("tcp_server_uploadPic: uploadPic failed. username:%s,code:%d", req.UserName, code)
-		return
-	}
+func UploadPicServ(ctx context.Context, req utils.ReqUploadPic) (res utils.ResUploadPic, err error) {
 	//token success, invalid redis data
-	code = dao.Invalid(req.UserName)
+	code := dao.Invalid(req.UserName)
 	if code != utils.Success {
 		//if err, return
 		res.Code = utils.ErrRedisSet
@@ -215,19 +262,76 @@ func UploadPicServ(req utils.ReqUploadPic) (res utils.ResUploadPic) {
 	//update db
 	code = dao.UploadPic(req.UserName, req.Picture)
 	res.Code = code
+	if code == utils.Success {
+		publishUser(req.UserName, utils.EventPicture)
+	}
 	fmt.Println("tcp_server_uploadPic: upload success. username:", req.UserName)
 	//log.InfoLog("tcp_server_uploadPic: upload success. username:%s", req.UserName)
 	return
 }
 
-//logout
-func LogoutServ(req utils.ReqLogout) (res utils.ResLogout) {
-	code := dao.CheckToken(req.UserName, req.Token)
-	if code != utils.Success {
-		res.Code = code
-		log.ErrorLog("tcp_server_Logout: logout failed. username:%s,code:%d", req.UserName, code)
+//upload picture service, the picture bytes come in chunks over the stream
+//and are checked and saved here
+func UploadPicStreamServ(ctx context.Context, req utils.ReqUploadPicStream, st *rpc.ServerStream) (res utils.ResUploadPic, err error) {
+	if !utils.CheckImage(req.FileName) {
+		res.Code = utils.ErrPicFormat
 		return
 	}
+	//rename the image to avoid name repeat
+	newName := utils.NewImgName(req.FileName)
+	filepath := utils.StaticFilePath + newName
+	file, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		log.ErrorLog("tcp_server_uploadPicStream: create file failed. username:%s, err:%s", req.UserName, err)
+		res.Code = utils.Err
+		return res, nil
+	}
+	code, err := receivePic(st, file)
+	file.Close()
+	if code == utils.Success {
+		res, err = UploadPicServ(ctx, utils.ReqUploadPic{UserName: req.UserName, Picture: newName, Token: req.Token})
+		code = res.Code
+	}
+	if code != utils.Success {
+		os.Remove(filepath)
+	}
+	res.Code = code
+	return
+}
+
+//write the chunks of the stream to file, the picture must be an image no
+//bigger than utils.PicMaxSize
+func receivePic(st *rpc.ServerStream, file *os.File) (int, error) {
+	size := 0
+	for {
+		var chunk utils.PicChunk
+		err := st.Recv(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return utils.Err, err
+		}
+		//the first bytes tell the real format, whatever the file name says
+		if size == 0 && !utils.IsImageData(chunk.Data) {
+			return utils.ErrPicFormat, nil
+		}
+		size += len(chunk.Data)
+		if size > utils.PicMaxSize {
+			return utils.ErrPicSize, nil
+		}
+		if _, err = file.Write(chunk.Data); err != nil {
+			return utils.Err, err
+		}
+	}
+	if size == 0 {
+		return utils.ErrPicFormat, nil
+	}
+	return utils.Success, nil
+}
+
+//logout
+func LogoutServ(ctx context.Context, req utils.ReqLogout) (res utils.ResLogout, err error) {
 	//token success, invalid redis data
 	rCode := dao.SetToken(req.UserName, "", 0)
 	if rCode != utils.Success {
@@ -235,5 +339,13 @@ func LogoutServ(req utils.ReqLogout) (res utils.ResLogout) {
 		return
 	}
 	log.InfoLog("tcp_server_logout: logout success. username:%s", req.UserName)
+	publishUser(req.UserName, utils.EventLogout)
 	return
 }
+
+//tell the httpservers that the user changed
+func publishUser(userName string, event string) {
+	if _, err := _server.Publish(utils.TopicUser, utils.UserEvent{UserName: userName, Event: event}); err != nil {
+		log.ErrorLog("tcp_server_publish: publish %s failed. username:%s, err:%s", event, userName, err)
+	}
+}
@@ -14,6 +14,8 @@ const (
 	ErrNil          = 1007
 	ErrRedisSet     = 1008
 	ErrRedisGet     = 1009
+	ErrPicFormat    = 1010
+	ErrPicSize      = 1011
 	//ErrRdsSet       = 1009
 )
 
@@ -30,6 +32,8 @@ var codeMsg = map[int]string{
 	ErrNil:          "用户名或密码为空",
 	ErrRedisSet:     "添加token错误",
 	ErrRedisGet:     "获取token错误",
+	ErrPicFormat:    "图片格式错误",
+	ErrPicSize:      "图片过大",
 }
 
 //return err information
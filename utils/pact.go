@@ -1,5 +1,21 @@
 package utils
 
+//requests of one user, httpserver sends the calls of the same user to the same tcpserver
+type UserReq interface {
+	GetUserName() string
+}
+
+//requests which carry the login token, the tcp server checks it before the service runs
+type TokenReq interface {
+	UserReq
+	GetToken() string
+}
+
+//responses which carry a code
+type CodeRes interface {
+	SetCode(code int)
+}
+
 //add request
 type ReqAdd struct {
 	UserName string `json:"username"`
@@ -7,6 +23,8 @@ type ReqAdd struct {
 	NickName string `json:"nickname"`
 }
 
+func (r ReqAdd) GetUserName() string { return r.UserName }
+
 //add response
 type ResAdd struct {
 	Code int `json:"code"`
@@ -23,6 +41,8 @@ type ReqLogin struct {
 	PassWord string `json:"password"`
 }
 
+func (r ReqLogin) GetUserName() string { return r.UserName }
+
 //login response
 type ResLogin struct {
 	UserName string `json:"username"`
@@ -41,6 +61,9 @@ type ReqGetInfo struct {
 	Token    string `json:"token"`
 }
 
+func (r ReqGetInfo) GetUserName() string { return r.UserName }
+func (r ReqGetInfo) GetToken() string    { return r.Token }
+
 //getinfo response
 type ResGetInfo struct {
 	Code           int    `json:"code"`
@@ -49,6 +72,8 @@ type ResGetInfo struct {
 	ProfilePicture string `json:"profilepicture"`
 }
 
+func (r *ResGetInfo) SetCode(code int) { r.Code = code }
+
 //send msg
 type MsgGetInfo struct {
 	UserName       string
@@ -63,11 +88,16 @@ type ReqUpdNickName struct {
 	Token    string `json:"token"`
 }
 
+func (r ReqUpdNickName) GetUserName() string { return r.UserName }
+func (r ReqUpdNickName) GetToken() string    { return r.Token }
+
 //update nickname response
 type ResUpdNickName struct {
 	Code int `json:"code"`
 }
 
+func (r *ResUpdNickName) SetCode(code int) { r.Code = code }
+
 //send msg
 type MsgUpdNickName struct {
 	Msg string
@@ -80,11 +110,31 @@ type ReqUploadPic struct {
 	Token    string `json:"token"`
 }
 
+func (r ReqUploadPic) GetUserName() string { return r.UserName }
+func (r ReqUploadPic) GetToken() string    { return r.Token }
+
 //upload picture response
 type ResUploadPic struct {
 	Code int `json:"code"`
 }
 
+func (r *ResUploadPic) SetCode(code int) { r.Code = code }
+
+//upload picture by stream request, the chunks of the picture follow it
+type ReqUploadPicStream struct {
+	UserName string `json:"username"`
+	FileName string `json:"filename"`
+	Token    string `json:"token"`
+}
+
+func (r ReqUploadPicStream) GetUserName() string { return r.UserName }
+func (r ReqUploadPicStream) GetToken() string    { return r.Token }
+
+//one chunk of the picture bytes
+type PicChunk struct {
+	Data []byte `json:"data"`
+}
+
 //send msg
 type MsgUploadPic struct {
 	Msg string
@@ -102,13 +152,34 @@ type ReqLogout struct {
 	Token    string `json:"token"`
 }
 
+func (r ReqLogout) GetUserName() string { return r.UserName }
+func (r ReqLogout) GetToken() string    { return r.Token }
+
 //logour response
 type ResLogout struct {
 	Token string `json:"token"`
 	Code  int    `json:"code"`
 }
 
+func (r *ResLogout) SetCode(code int) { r.Code = code }
+
 //send msg
 type MsgLogout struct {
 	Msg string
 }
+
+//topic of the user events tcpserver publishes to httpserver
+const TopicUser = "user"
+
+//what changed about the user
+const (
+	EventNickName = "nickname"
+	EventPicture  = "picture"
+	EventLogout   = "logout"
+)
+
+//user event, pushed when a session is revoked or a profile changes
+type UserEvent struct {
+	UserName string `json:"username"`
+	Event    string `json:"event"`
+}
@@ -8,10 +8,51 @@ import (
 )
 
 var (
-	AppMode        string
-	ServerPort     string
-	HTTPServerPort string
-	ClientPoolSize int
+	AppMode            string
+	ServerPort         string
+	HTTPServerPort     string
+	ClientPoolSize     int
+	CallTimeout        time.Duration
+	MaxFrameSize       int
+	RpcCodec           string
+	RpcEndpoints       []string
+	RpcNetwork         string
+	RpcBalancer        string
+	RpcDiscovery       string
+	RpcSRV             string
+	RpcEndpointsFile   string
+	RpcResolveInterval time.Duration
+	BreakerWindow      time.Duration
+	BreakerMinRequests int
+	BreakerErrorRate   float64
+	BreakerSlowCall    time.Duration
+	BreakerSlowRate    float64
+	BreakerOpenFor     time.Duration
+	TLSEnable          bool
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSClientCAFile    string
+	TLSCAFile          string
+	TLSClientCertFile  string
+	TLSClientKeyFile   string
+	TLSServerName      string
+	AuthKeys           string
+	AuthKeyID          string
+	TestTokenEnable    bool
+	RetryTimes         int
+	RetryBackoff       time.Duration
+	ShutdownWait       time.Duration
+	HeartbeatInterval  time.Duration
+	HeartbeatTimeout   time.Duration
+	IdleTimeout        time.Duration
+	BatchWorkers       int
+	RpcCompression     []string
+	RpcCompressSize    int
+	PoolMinConns       int
+	PoolMaxStreams     int
+	PoolIdleTimeout    time.Duration
+	PoolWaitTimeout    time.Duration
+	RpcLimits          map[string]string
 
 	Db              string
 	DbHost          string
@@ -31,6 +72,8 @@ var (
 
 	StaticFilePath string
 	DefaultImage   string
+	PicMaxSize     int
+	PicChunkSize   int
 
 	TCPServerLogPath  string
 	HTTPServerLogPath string
@@ -46,12 +89,57 @@ func init() {
 	loadRedis(file)
 	loadStatic(file)
 	loadLog(file)
+	loadLimits(file)
 }
 func loadServer(file *ini.File) {
 	AppMode = file.Section("server").Key("AppMode").MustString("debug")
 	ServerPort = file.Section("server").Key("HttpPort").MustString(":3000")
 	ClientPoolSize, _ = file.Section("server").Key("ClientPoolSize").Int()
 	HTTPServerPort = file.Section("server").Key("HTTPServerPort").MustString("1806")
+	MaxFrameSize = file.Section("server").Key("MaxFrameSize").MustInt(4 << 20)
+	RpcCodec = file.Section("server").Key("RpcCodec").MustString("json")
+	RpcEndpoints = file.Section("server").Key("RpcEndpoints").Strings(",")
+	if len(RpcEndpoints) == 0 {
+		RpcEndpoints = []string{ServerPort}
+	}
+	RpcBalancer = file.Section("server").Key("RpcBalancer").MustString("round_robin")
+	RpcNetwork = file.Section("server").Key("RpcNetwork").MustString("tcp")
+	RpcDiscovery = file.Section("server").Key("RpcDiscovery").MustString("static")
+	RpcSRV = file.Section("server").Key("RpcSRV").String()
+	RpcEndpointsFile = file.Section("server").Key("RpcEndpointsFile").String()
+	RpcResolveInterval = time.Duration(file.Section("server").Key("RpcResolveInterval").MustInt(10000)) * time.Millisecond
+	BreakerWindow = time.Duration(file.Section("server").Key("BreakerWindow").MustInt(10000)) * time.Millisecond
+	BreakerMinRequests = file.Section("server").Key("BreakerMinRequests").MustInt(20)
+	BreakerErrorRate = float64(file.Section("server").Key("BreakerErrorRate").MustInt(50)) / 100
+	BreakerSlowCall = time.Duration(file.Section("server").Key("BreakerSlowCall").MustInt(1000)) * time.Millisecond
+	BreakerSlowRate = float64(file.Section("server").Key("BreakerSlowRate").MustInt(50)) / 100
+	BreakerOpenFor = time.Duration(file.Section("server").Key("BreakerOpenFor").MustInt(5000)) * time.Millisecond
+	TLSEnable = file.Section("server").Key("TLSEnable").MustBool(false)
+	TLSCertFile = file.Section("server").Key("TLSCertFile").String()
+	TLSKeyFile = file.Section("server").Key("TLSKeyFile").String()
+	TLSClientCAFile = file.Section("server").Key("TLSClientCAFile").String()
+	TLSCAFile = file.Section("server").Key("TLSCAFile").String()
+	TLSClientCertFile = file.Section("server").Key("TLSClientCertFile").String()
+	TLSClientKeyFile = file.Section("server").Key("TLSClientKeyFile").String()
+	TLSServerName = file.Section("server").Key("TLSServerName").String()
+	AuthKeys = file.Section("server").Key("AuthKeys").String()
+	AuthKeyID = file.Section("server").Key("AuthKeyID").String()
+	//stress test switch, off unless set by hand, never shipped in config.ini
+	TestTokenEnable = file.Section("server").Key("TestTokenEnable").MustBool(false)
+	RetryTimes = file.Section("server").Key("RetryTimes").MustInt(3)
+	RetryBackoff = time.Duration(file.Section("server").Key("RetryBackoff").MustInt(50)) * time.Millisecond
+	CallTimeout = time.Duration(file.Section("server").Key("CallTimeout").MustInt(3000)) * time.Millisecond
+	ShutdownWait = time.Duration(file.Section("server").Key("ShutdownWait").MustInt(10000)) * time.Millisecond
+	HeartbeatInterval = time.Duration(file.Section("server").Key("HeartbeatInterval").MustInt(10000)) * time.Millisecond
+	HeartbeatTimeout = time.Duration(file.Section("server").Key("HeartbeatTimeout").MustInt(3000)) * time.Millisecond
+	IdleTimeout = time.Duration(file.Section("server").Key("IdleTimeout").MustInt(60000)) * time.Millisecond
+	BatchWorkers = file.Section("server").Key("BatchWorkers").MustInt(8)
+	RpcCompression = file.Section("server").Key("RpcCompression").Strings(",")
+	RpcCompressSize = file.Section("server").Key("RpcCompressSize").MustInt(1024)
+	PoolMinConns = file.Section("server").Key("PoolMinConns").MustInt(1)
+	PoolMaxStreams = file.Section("server").Key("PoolMaxStreams").MustInt(64)
+	PoolIdleTimeout = time.Duration(file.Section("server").Key("PoolIdleTimeout").MustInt(30000)) * time.Millisecond
+	PoolWaitTimeout = time.Duration(file.Section("server").Key("PoolWaitTimeout").MustInt(1000)) * time.Millisecond
 
 }
 
@@ -76,6 +164,14 @@ func loadRedis(file *ini.File) {
 func loadStatic(file *ini.File) {
 	StaticFilePath = file.Section("static").Key("StaticFilePath").MustString("./static/")
 	DefaultImage = file.Section("static").Key("DefaultImage").MustString("girl.jpg")
+	PicMaxSize = file.Section("static").Key("PicMaxSize").MustInt(2 << 20)
+	PicChunkSize = file.Section("static").Key("PicChunkSize").MustInt(32 << 10)
+}
+func loadLimits(file *ini.File) {
+	RpcLimits = make(map[string]string)
+	for _, key := range file.Section("limits").Keys() {
+		RpcLimits[key.Name()] = key.String()
+	}
 }
 func loadLog(file *ini.File) {
 	TCPServerLogPath = file.Section("log").Key("hTCPServerLogPath").MustString("./log/tcp_server.log")
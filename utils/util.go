@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"io"
 	"mime/multipart"
+	"net/http"
 	"os"
 	"path"
 
@@ -51,6 +52,15 @@ func CheckImage(name string) bool {
 	return false
 }
 
+//check whether the first bytes of a file are a png,jpeg or gif image
+func IsImageData(head []byte) bool {
+	switch http.DetectContentType(head) {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
 //generate new name of image to avoid repeat
 func NewImgName(name string) string {
 	n := path.Ext(name)